@@ -0,0 +1,498 @@
+// Package client wraps the coordinator's grpc API, so consumers don't need to
+// deal with connection setup and stream handling themselves.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/metno/rove/internal/rovecore"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidRequest is returned when the coordinator rejects a request,
+	// e.g. because it names a test that doesn't exist
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrUnavailable is returned when the coordinator can't be reached
+	ErrUnavailable = errors.New("coordinator unavailable")
+)
+
+const (
+	// ErrorDomain is the domain of the ErrorInfo details the coordinator
+	// attaches to the errors it returns
+	ErrorDomain = rovecore.ErrorDomain
+	// ReasonUnknownTests is the ErrorInfo reason for a request naming tests
+	// that aren't in the dag. The tests are listed, comma separated, under
+	// the "tests" metadata key
+	ReasonUnknownTests = rovecore.ReasonUnknownTests
+)
+
+// Flag is the result of a single test on a single piece of data
+type Flag struct {
+	DataId uint32
+	FlagId uint32
+	Flag   pb.Flag
+	// ErrorMessage says why the test couldn't be run, if Flag is ERROR, or
+	// why it was skipped
+	ErrorMessage string
+	// Verdict is set on the overall verdict for the data, sent after all the
+	// test flags if the coordinator is configured to. Its Flag is the verdict,
+	// and FlagId, Description and Severity are unset.
+	Verdict bool
+	// Complete is set on the last flag of a validation that ran all its
+	// tests. Only DataId, Completed and Total are set on it.
+	Complete bool
+	// RequestId is the id of the validation that produced the flag, as used
+	// in the coordinator's logs
+	RequestId string
+
+	// StartedAt and Duration say when the test ran and how long it took.
+	// They are zero if the test wasn't run.
+	StartedAt time.Time
+	Duration  time.Duration
+
+	// Description and Severity describe the test that produced the flag
+	Description string
+	Severity    pb.Severity
+
+	// Completed is how many of the validation's Total tests had finished
+	// when this flag was sent, including this one
+	Completed uint32
+	Total     uint32
+}
+
+// RetryPolicy controls how a validation is retried when the connection to
+// the coordinator drops partway through
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first. 1
+	// disables retrying.
+	MaxAttempts int
+	// InitialBackoff is how long to wait before the first retry. It doubles
+	// after each attempt, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the RetryPolicy used by clients returned from Dial
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 200 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// Client is a connection to a coordinator. It is safe for concurrent use.
+type Client struct {
+	conn        *grpc.ClientConn
+	coordinator pb.CoordinatorClient
+
+	// Retry may be changed before the client is used
+	Retry RetryPolicy
+}
+
+// Dial connects to the coordinator at address. The connection is insecure
+// unless opts provide transport credentials.
+func Dial(address string, opts ...grpc.DialOption) (*Client, error) {
+	return dial(context.Background(), address, opts...)
+}
+
+// DialTimeout is like Dial, but waits up to timeout for the coordinator to be
+// reachable, failing with an error matching ErrUnavailable if it isn't.
+// Otherwise calls on a client of a coordinator that is down wait for it to
+// come up for as long as their context allows.
+func DialTimeout(address string, timeout time.Duration, opts ...grpc.DialOption) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	c, err := dial(ctx, address, append(opts, grpc.WithBlock())...)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("%w: coordinator at %s unreachable after %v", ErrUnavailable, address, timeout)
+	}
+	return c, err
+}
+
+func dial(ctx context.Context, address string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// ping idle connections so proxies don't drop long validations
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 30 * time.Second, Timeout: 20 * time.Second, PermitWithoutStream: true}),
+	}, opts...)
+
+	conn, err := grpc.DialContext(ctx, address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to coordinator: %w", err)
+	}
+
+	return &Client{conn: conn, coordinator: pb.NewCoordinatorClient(conn), Retry: DefaultRetryPolicy}, nil
+}
+
+type requestIdKey struct{}
+
+// requestIdHeader is the grpc metadata key request ids are passed in
+const requestIdHeader = "x-request-id"
+
+// WithRequestId returns a context that makes validations started with it use
+// request_id as their id, so they can be cancelled with Cancel while they run
+func WithRequestId(ctx context.Context, request_id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, request_id)
+}
+
+type pipelineKey struct{}
+
+// WithPipeline returns a context that makes validations and plans made with it
+// take their tests from the coordinator's pipeline called name, rather than
+// its default pipeline
+func WithPipeline(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, pipelineKey{}, name)
+}
+
+// Close closes the connection to the coordinator
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ValidateStream runs tests, and everything they depend on, on the data
+// identified by data_id. callback is called with each flag as it arrives. If
+// callback returns an error the validation is abandoned and that error is
+// returned.
+//
+// If the connection to the coordinator drops, the validation is reissued
+// according to c.Retry once the coordinator is reachable again. Flags already
+// passed to callback are not passed again.
+func (c *Client) ValidateStream(ctx context.Context, data_id uint32, tests []string, callback func(Flag) error) error {
+	// form: delivered[flag_id]
+	delivered := make(map[uint32]bool)
+
+	backoff := c.Retry.InitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		retry, err := c.validateOnce(ctx, data_id, tests, delivered, callback)
+		if !retry || attempt >= c.Retry.MaxAttempts {
+			return err
+		}
+
+		// wait somewhere between half and all of backoff, so clients that
+		// lost the coordinator at the same time don't all come back at once
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		backoff *= 2
+		if backoff > c.Retry.MaxBackoff {
+			backoff = c.Retry.MaxBackoff
+		}
+	}
+}
+
+// validateOnce makes a single attempt at a validation, skipping flags that are
+// already in delivered. retry reports whether it failed in a way that's worth
+// trying again.
+func (c *Client) validateOnce(ctx context.Context, data_id uint32, tests []string, delivered map[uint32]bool, callback func(Flag) error) (retry bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	request_id, _ := ctx.Value(requestIdKey{}).(string)
+	pipeline, _ := ctx.Value(pipelineKey{}).(string)
+	if request_id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, requestIdHeader, request_id)
+	}
+
+	stream, err := c.coordinator.ValidateOne(
+		ctx,
+		&pb.ValidateOneRequest{DataId: data_id, Tests: tests, RequestId: request_id, Pipeline: pipeline},
+		// wait for the connection to come back rather than failing immediately
+		// if the coordinator is restarting
+		grpc.WaitForReady(true),
+	)
+	if err != nil {
+		return retryable(err), translateError(err)
+	}
+
+	// the coordinator sends the request id back, including ones it
+	// generated. if this fails Recv returns the error
+	var stream_request_id string
+	if header, err := stream.Header(); err == nil {
+		if ids := header.Get(requestIdHeader); len(ids) > 0 {
+			stream_request_id = ids[0]
+		}
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return retryable(err), translateError(err)
+		}
+
+		if resp.Heartbeat {
+			continue
+		}
+
+		// the verdict and completion have no FlagId of their own, so don't go
+		// through the deduplication
+		if !resp.Verdict && !resp.Complete {
+			if delivered[resp.FlagId] {
+				continue
+			}
+			delivered[resp.FlagId] = true
+		}
+
+		flag := Flag{
+			DataId:       resp.DataId,
+			FlagId:       resp.FlagId,
+			Flag:         resp.Flag,
+			Description:  resp.Description,
+			Severity:     resp.Severity,
+			Completed:    resp.Completed,
+			Total:        resp.Total,
+			ErrorMessage: resp.ErrorMessage,
+			Verdict:      resp.Verdict,
+			Complete:     resp.Complete,
+			RequestId:    stream_request_id,
+		}
+		if resp.StartedAt != nil {
+			flag.StartedAt = resp.StartedAt.AsTime()
+			flag.Duration = resp.Duration.AsDuration()
+		}
+		if err := callback(flag); err != nil {
+			return false, err
+		}
+	}
+}
+
+// Plan returns the tests that validating with tests would run, without
+// running them. They are grouped into levels that can run in parallel, with
+// the tests in the first level running first.
+func (c *Client) Plan(ctx context.Context, tests []string) ([][]string, error) {
+	pipeline, _ := ctx.Value(pipelineKey{}).(string)
+	resp, err := c.coordinator.PlanValidation(ctx, &pb.PlanValidationRequest{Tests: tests, Pipeline: pipeline})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	levels := make([][]string, len(resp.Levels))
+	for i, level := range resp.Levels {
+		levels[i] = level.Tests
+	}
+
+	return levels, nil
+}
+
+// Test is a test that can be requested from the coordinator
+type Test struct {
+	Name        string
+	Description string
+	Severity    pb.Severity
+	// Groups the test can be requested by, as "@group"
+	Groups []string
+	// DependsOn are the tests that are run before this one when it is
+	// requested
+	DependsOn []string
+	// Parameters are the test's configuration, like thresholds
+	Parameters map[string]float64
+}
+
+// ListTests returns the tests that can be requested, sorted by name. If ctx
+// was made by WithPipeline, they are the tests in that pipeline.
+func (c *Client) ListTests(ctx context.Context) ([]Test, error) {
+	pipeline, _ := ctx.Value(pipelineKey{}).(string)
+	resp, err := c.coordinator.ListTests(ctx, &pb.ListTestsRequest{Pipeline: pipeline})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	tests := make([]Test, len(resp.Tests))
+	for i, test := range resp.Tests {
+		tests[i] = Test{
+			Name:        test.Name,
+			Description: test.Description,
+			Severity:    test.Severity,
+			Groups:      test.Groups,
+			DependsOn:   test.DependsOn,
+			Parameters:  test.Parameters,
+		}
+	}
+
+	return tests, nil
+}
+
+// Dag is the structure of a pipeline, the tests in it and which depend on
+// which
+type Dag struct {
+	// Tests are the names of the tests in the dag, sorted
+	Tests []string
+	// Edges are [parent, child] pairs, where the parent depends on the
+	// child. Sorted by parent, then child
+	Edges [][2]string
+	// Leaves are the tests that depend on no others, and run first
+	Leaves []string
+}
+
+// Dot formats the dag as a Graphviz DOT graph, with an edge from each test to
+// each test it depends on
+func (d Dag) Dot() string {
+	return rovecore.Dot(d.Tests, d.Edges)
+}
+
+// GetDag returns the structure of the coordinator's pipeline, the one chosen
+// by WithPipeline if ctx was made by it. If tests are given, it is only the
+// part of the pipeline that validating with tests would run.
+func (c *Client) GetDag(ctx context.Context, tests []string) (Dag, error) {
+	pipeline, _ := ctx.Value(pipelineKey{}).(string)
+	resp, err := c.coordinator.GetDag(ctx, &pb.GetDagRequest{Pipeline: pipeline, Tests: tests})
+	if err != nil {
+		return Dag{}, translateError(err)
+	}
+
+	dag := Dag{Tests: resp.Nodes, Leaves: resp.Leaves}
+	for _, edge := range resp.Edges {
+		dag.Edges = append(dag.Edges, [2]string{edge.Parent, edge.Child})
+	}
+
+	return dag, nil
+}
+
+// Validation is a validation running on the coordinator
+type Validation struct {
+	RequestId string
+	DataId    uint32
+	Tests     []string
+	Start     time.Time
+	// Completed is how many of the validation's Total tests have finished
+	Completed uint32
+	Total     uint32
+}
+
+// ListValidations returns the validations currently running on the
+// coordinator, oldest first
+func (c *Client) ListValidations(ctx context.Context) ([]Validation, error) {
+	resp, err := c.coordinator.ListValidations(ctx, &pb.ListValidationsRequest{})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	validations := make([]Validation, len(resp.Validations))
+	for i, validation := range resp.Validations {
+		validations[i] = Validation{
+			RequestId: validation.RequestId,
+			DataId:    validation.DataId,
+			Tests:     validation.Tests,
+			Start:     validation.StartTime.AsTime(),
+			Completed: validation.Completed,
+			Total:     validation.Total,
+		}
+	}
+
+	return validations, nil
+}
+
+// Cancel stops the running validation that was started with request_id (see
+// WithRequestId). The validation's ValidateStream returns context.Canceled.
+func (c *Client) Cancel(ctx context.Context, request_id string) error {
+	_, err := c.coordinator.CancelValidation(ctx, &pb.CancelValidationRequest{RequestId: request_id})
+	if err != nil {
+		return translateError(err)
+	}
+
+	return nil
+}
+
+// retryable reports whether a grpc error is caused by losing the connection,
+// rather than by the coordinator rejecting or failing the request
+func retryable(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+// Validate is like ValidateStream, but collects all the flags and returns
+// them once the validation is complete
+func (c *Client) Validate(ctx context.Context, data_id uint32, tests []string) ([]Flag, error) {
+	var flags []Flag
+
+	err := c.ValidateStream(ctx, data_id, tests, func(flag Flag) error {
+		flags = append(flags, flag)
+		return nil
+	})
+
+	return flags, err
+}
+
+// FlagRank orders flags from best to worst, the order the coordinator's
+// worst-of verdict policy uses. A skipped test ranks with OK, and flags that
+// aren't test results, like UNSPECIFIED, rank below all of them.
+func FlagRank(flag pb.Flag) int {
+	return rovecore.FlagRank(flag)
+}
+
+// InvalidRequestError is returned when the coordinator rejects a request. It
+// matches ErrInvalidRequest with errors.Is.
+type InvalidRequestError struct {
+	Message string
+	// UnknownTests are the requested tests the coordinator doesn't know, if
+	// that is why the request was rejected
+	UnknownTests []string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return fmt.Sprintf("%v: %s", ErrInvalidRequest, e.Message)
+}
+
+func (e *InvalidRequestError) Unwrap() error {
+	return ErrInvalidRequest
+}
+
+// invalidRequestError fills in an InvalidRequestError from the error details
+// the coordinator attached to st
+func invalidRequestError(st *status.Status) error {
+	err := &InvalidRequestError{Message: st.Message()}
+
+	for _, detail := range st.Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != ErrorDomain {
+			continue
+		}
+
+		if info.Reason == ReasonUnknownTests && info.Metadata["tests"] != "" {
+			err.UnknownTests = strings.Split(info.Metadata["tests"], ",")
+		}
+	}
+
+	return err
+}
+
+// translateError turns grpc status errors into errors that can be checked
+// with errors.Is, without callers needing to know about grpc codes
+func translateError(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	switch st.Code() {
+	case codes.InvalidArgument, codes.NotFound:
+		return invalidRequestError(st)
+	case codes.Unavailable:
+		return fmt.Errorf("%w: %s", ErrUnavailable, st.Message())
+	case codes.Canceled:
+		return context.Canceled
+	case codes.DeadlineExceeded:
+		return context.DeadlineExceeded
+	default:
+		return err
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/metno/rove/client"
+	"strings"
+)
+
+func runDag(args []string) error {
+	flags := flag.NewFlagSet("dag", flag.ExitOnError)
+	dial := addDialFlags(flags)
+	pipeline := flags.String("pipeline", "", "pipeline to print, the coordinator's default pipeline if empty")
+	tests := flags.String("tests", "", "comma separated tests to print the subdag a validation of them would run for. the whole pipeline is printed if empty")
+	flags.Parse(args)
+
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if *pipeline != "" {
+		ctx = client.WithPipeline(ctx, *pipeline)
+	}
+
+	var test_names []string
+	if *tests != "" {
+		test_names = strings.Split(*tests, ",")
+	}
+
+	dag, err := c.GetDag(ctx, test_names)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(dag.Dot())
+
+	return nil
+}
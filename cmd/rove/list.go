@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func runList(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	dial := addDialFlags(flags)
+	flags.Parse(args)
+
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	validations, err := c.ListValidations(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, validation := range validations {
+		fmt.Printf(
+			"%s: data %d [%s] %d/%d tests complete, running for %s\n",
+			validation.RequestId,
+			validation.DataId,
+			strings.Join(validation.Tests, ","),
+			validation.Completed,
+			validation.Total,
+			time.Since(validation.Start).Round(time.Second),
+		)
+	}
+
+	return nil
+}
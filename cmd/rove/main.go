@@ -0,0 +1,102 @@
+// rove is the command line tool for working with a rove coordinator. It is run
+// as rove <command> [flags], see rove help for the commands.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/metno/rove/client"
+	"github.com/metno/rove/coordinator"
+	"github.com/metno/rove/version"
+	"os"
+	"sort"
+	"time"
+)
+
+// exitCode is returned by a command that wants to exit with a particular
+// code, without it being reported as an error
+type exitCode int
+
+func (code exitCode) Error() string {
+	return fmt.Sprintf("exit code %d", int(code))
+}
+
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"coordinator": {summary: "run a coordinator", run: runCoordinator},
+	"dag":         {summary: "print a pipeline, or the part of it a validation would run, as a Graphviz DOT graph", run: runDag},
+	"list":        {summary: "list the validations running on the coordinator", run: runList},
+	"plan":        {summary: "show which tests a validation would run, without running them", run: runPlan},
+	"tests":       {summary: "list the tests that can be requested", run: runTests},
+	"validate":    {summary: "run tests on a piece of data and print the flags", run: runValidate},
+	"version":     {summary: "print build information", run: runVersion},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: rove <command> [flags]\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun rove <command> -h for its flags\n")
+}
+
+// addDialFlags adds the flags for reaching the coordinator to a command that
+// talks to one, and returns a function that connects to it as they say
+func addDialFlags(flags *flag.FlagSet) func() (*client.Client, error) {
+	address := flags.String("address", ":50051", "address of the coordinator")
+	connect_timeout := flags.Duration("connect-timeout", 10*time.Second, "how long to wait for the coordinator to be reachable before giving up")
+
+	return func() (*client.Client, error) {
+		return client.DialTimeout(*address, *connect_timeout)
+	}
+}
+
+func runCoordinator(args []string) error {
+	coordinator.Main(args)
+	return nil
+}
+
+func runVersion(args []string) error {
+	fmt.Printf("rove %s\n", version.String())
+	return nil
+}
+
+func main() {
+	if len(os.Args) == 2 && os.Args[1] == "--version" {
+		runVersion(nil)
+		return
+	}
+	if len(os.Args) < 2 || os.Args[1] == "help" || os.Args[1] == "-h" || os.Args[1] == "--help" {
+		usage()
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rove: unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		var code exitCode
+		if errors.As(err, &code) {
+			os.Exit(int(code))
+		}
+		fmt.Fprintf(os.Stderr, "rove %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
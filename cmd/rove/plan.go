@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/metno/rove/client"
+	"strings"
+)
+
+func runPlan(args []string) error {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	dial := addDialFlags(flags)
+	tests := flags.String("tests", "", "comma separated tests to plan, tests they depend on are included too")
+	pipeline := flags.String("pipeline", "", "pipeline to take the tests from, the coordinator's default pipeline if empty")
+	flags.Parse(args)
+
+	if *tests == "" {
+		return errors.New("--tests is required")
+	}
+
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if *pipeline != "" {
+		ctx = client.WithPipeline(ctx, *pipeline)
+	}
+
+	levels, err := c.Plan(ctx, strings.Split(*tests, ","))
+	if err != nil {
+		return err
+	}
+
+	for i, level := range levels {
+		fmt.Printf("level %d: [%s]\n", i, strings.Join(level, ","))
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/metno/rove/client"
+	"strings"
+)
+
+func runTests(args []string) error {
+	flags := flag.NewFlagSet("tests", flag.ExitOnError)
+	dial := addDialFlags(flags)
+	pipeline := flags.String("pipeline", "", "pipeline to list the tests of, the coordinator's default pipeline if empty")
+	flags.Parse(args)
+
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if *pipeline != "" {
+		ctx = client.WithPipeline(ctx, *pipeline)
+	}
+
+	tests, err := c.ListTests(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, test := range tests {
+		fmt.Printf("%s (severity: %s): %s\n", test.Name, strings.ToLower(test.Severity.String()), test.Description)
+		if len(test.Groups) > 0 {
+			fmt.Printf("  groups: %s\n", strings.Join(test.Groups, ","))
+		}
+		if len(test.DependsOn) > 0 {
+			fmt.Printf("  depends on: %s\n", strings.Join(test.DependsOn, ","))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/metno/rove/client"
+	"github.com/metno/rove/internal/rovecore"
+	pb "github.com/metno/rove/proto"
+	"strconv"
+	"strings"
+)
+
+// parseExitCodes parses a comma separated list of FLAG=code pairs, like
+// "FAIL=3,ERROR=4"
+// form: exit_codes[flag]code
+func parseExitCodes(s string) (map[pb.Flag]int, error) {
+	exit_codes := make(map[pb.Flag]int)
+	if s == "" {
+		return exit_codes, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid exit code %q, expected FLAG=code", pair)
+		}
+		name, code := parts[0], parts[1]
+		flag, ok := pb.Flag_value[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok || flag == int32(pb.Flag_UNSPECIFIED) {
+			return nil, fmt.Errorf("unknown flag %q in exit codes", name)
+		}
+		exit_code, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil || exit_code < 0 || exit_code > 125 {
+			return nil, fmt.Errorf("invalid exit code %q for %s, expected 0 to 125", code, name)
+		}
+		exit_codes[pb.Flag(flag)] = exit_code
+	}
+
+	return exit_codes, nil
+}
+
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	dial := addDialFlags(flags)
+	data_id := flags.Uint("data-id", 0, "id of the data to validate")
+	tests := flags.String("tests", "", "comma separated tests to run, tests they depend on are run too")
+	request_id := flags.String("request-id", "", "id for the validation, so it can be cancelled. generated by the coordinator if empty")
+	pipeline := flags.String("pipeline", "", "pipeline to take the tests from, the coordinator's default pipeline if empty")
+	exit_codes_flag := flags.String("exit-codes", "FAIL=3,ERROR=4", "comma separated FLAG=code pairs giving the exit code for the overall verdict. other verdicts exit 0. the verdict is the coordinator's if it sends one, otherwise the worst flag")
+	flags.Parse(args)
+
+	if *data_id == 0 {
+		return errors.New("--data-id is required")
+	}
+	if *tests == "" {
+		return errors.New("--tests is required")
+	}
+	exit_codes, err := parseExitCodes(*exit_codes_flag)
+	if err != nil {
+		return err
+	}
+
+	c, err := dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if *request_id != "" {
+		ctx = client.WithRequestId(ctx, *request_id)
+	}
+	if *pipeline != "" {
+		ctx = client.WithPipeline(ctx, *pipeline)
+	}
+
+	// the coordinator's verdict if it sent one, otherwise the worst flag
+	verdict := pb.Flag_OK
+	got_verdict := false
+
+	err = c.ValidateStream(ctx, uint32(*data_id), strings.Split(*tests, ","), func(flag client.Flag) error {
+		if flag.Complete {
+			fmt.Printf("data %d fully validated\n", flag.DataId)
+			return nil
+		}
+		if flag.Verdict {
+			fmt.Printf("verdict: %s\n", flag.Flag)
+			verdict = flag.Flag
+			got_verdict = true
+			return nil
+		}
+		if !got_verdict && rovecore.FlagRank(flag.Flag) > rovecore.FlagRank(verdict) {
+			verdict = flag.Flag
+		}
+
+		fmt.Printf("%s (severity: %s): %s\n", flag.Description, strings.ToLower(flag.Severity.String()), flag.Flag)
+		if flag.ErrorMessage != "" {
+			fmt.Printf("error: %s\n", flag.ErrorMessage)
+		}
+		fmt.Printf("%d/%d tests complete\n", flag.Completed, flag.Total)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if code := exit_codes[verdict]; code != 0 {
+		return exitCode(code)
+	}
+	return nil
+}
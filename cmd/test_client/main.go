@@ -3,35 +3,35 @@ package main
 import (
 	"context"
 	"fmt"
-	"io"
+	"strings"
 
-	pb "github.com/metno/rove/proto"
-	"google.golang.org/grpc"
+	"github.com/metno/rove/client"
 )
 
 func main() {
-	conn, err := grpc.Dial(":50051", grpc.WithInsecure())
+	c, err := client.Dial(":50051")
 	if err != nil {
-		panic(fmt.Sprintf("can not connect with server %v", err))
+		panic(err)
 	}
+	defer c.Close()
 
-	client := pb.NewCoordinatorClient(conn)
-
-	in := pb.ValidateOneRequest{DataId: 1, Tests: []string{"test1"}}
-	stream, err := client.ValidateOne(context.Background(), &in)
-	if err != nil {
-		panic(fmt.Sprintf("open stream error %v", err))
-	}
-
-	for {
-		resp, err := stream.Recv()
-		if err == io.EOF {
-			break
+	err = c.ValidateStream(context.Background(), 1, []string{"test1"}, func(flag client.Flag) error {
+		if flag.Complete {
+			fmt.Printf("data %d fully validated\n", flag.DataId)
+			return nil
 		}
-		if err != nil {
-			panic(fmt.Sprintf("cannot receive %v", err))
+		if flag.Verdict {
+			fmt.Printf("verdict: %s\n", flag.Flag)
+			return nil
 		}
-		fmt.Printf("Resp received: %d\n", resp.FlagId)
+		fmt.Printf("%s (severity: %s): %s\n", flag.Description, strings.ToLower(flag.Severity.String()), flag.Flag)
+		if flag.ErrorMessage != "" {
+			fmt.Printf("error: %s\n", flag.ErrorMessage)
+		}
+		fmt.Printf("%d/%d tests complete\n", flag.Completed, flag.Total)
+		return nil
+	})
+	if err != nil {
+		panic(err)
 	}
-
 }
@@ -0,0 +1,77 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEntry is the audit log's record of a single validation
+type auditEntry struct {
+	RequestId string    `json:"request_id"`
+	DataId    uint32    `json:"data_id"`
+	Tests     []string  `json:"tests"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	// how many of each flag the validation produced
+	// form: Flags[flag_name]count
+	Flags map[string]int `json:"flags"`
+	// one of ok, cancelled, timed out or error
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+}
+
+// auditLog appends an entry for every validation to a file, as JSON lines.
+// Unlike the result sinks it writes synchronously and syncs after every
+// entry, so the trail survives a crash.
+type auditLog struct {
+	mutex   sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+// write fills in entry's outcome from err, the error the validation returned,
+// and appends it to the log
+func (l *auditLog) write(entry auditEntry, err error) {
+	switch {
+	case err == nil:
+		entry.Outcome = "ok"
+	case status.Code(err) == codes.Canceled:
+		entry.Outcome = "cancelled"
+		entry.Error = err.Error()
+	case status.Code(err) == codes.DeadlineExceeded:
+		entry.Outcome = "timed out"
+		entry.Error = err.Error()
+	default:
+		entry.Outcome = "error"
+		entry.Error = err.Error()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if err := l.encoder.Encode(entry); err != nil {
+		log.Printf("failed to write audit entry for request %s: %v", entry.RequestId, err)
+		return
+	}
+	if err := l.file.Sync(); err != nil {
+		log.Printf("failed to sync audit log: %v", err)
+	}
+}
+
+func (l *auditLog) Close() error {
+	return l.file.Close()
+}
@@ -0,0 +1,64 @@
+package coordinator
+
+import (
+	pb "github.com/metno/rove/proto"
+	"sync"
+	"time"
+)
+
+// resultCache holds the responses of completed validations, keyed by the
+// client's idempotency key, so a retried request can be answered without
+// running anything. Entries expire after ttl.
+type resultCache struct {
+	mutex sync.Mutex
+	ttl   time.Duration
+	// form: entries[idempotency_key]entry
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	// what was requested, so a key reused for a different request isn't
+	// answered with the wrong results
+	fingerprint string
+	responses   []*pb.ValidateResponse
+	expires     time.Time
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+}
+
+// get returns the cached responses for key. ok is false if there is no live
+// entry for it. mismatch is true if there is one, but for a different request.
+func (c *resultCache) get(key string, fingerprint string) (responses []*pb.ValidateResponse, ok bool, mismatch bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false, false
+	}
+	if entry.fingerprint != fingerprint {
+		return nil, false, true
+	}
+
+	return entry.responses, true, false
+}
+
+// put caches the responses of a completed validation under key
+func (c *resultCache) put(key string, fingerprint string, responses []*pb.ValidateResponse) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+
+	// expired entries are only ever cleaned up here, so the cache can't grow
+	// beyond what was put in during the last ttl
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[key] = cacheEntry{fingerprint: fingerprint, responses: responses, expires: now.Add(c.ttl)}
+}
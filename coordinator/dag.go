@@ -0,0 +1,607 @@
+package coordinator
+
+import (
+	"fmt"
+	"github.com/intarga/dagrid"
+	"github.com/metno/rove/internal/rovecore"
+	"sort"
+	"strings"
+)
+
+// Children, Parents and Leaves are sets, so ranging over them directly gives
+// a different order every time. These return them as sorted slices instead,
+// so scheduling is reproducible.
+// TODO: move these to package dagrid as SortedChildren/SortedParents
+
+func sortedChildren(dag *dagrid.Dag, index int) []int {
+	children := make([]int, 0, len(dag.Nodes[index].Children))
+	for child := range dag.Nodes[index].Children {
+		children = append(children, child)
+	}
+	sort.Ints(children)
+	return children
+}
+
+func sortedParents(dag *dagrid.Dag, index int) []int {
+	parents := make([]int, 0, len(dag.Nodes[index].Parents))
+	for parent := range dag.Nodes[index].Parents {
+		parents = append(parents, parent)
+	}
+	sort.Ints(parents)
+	return parents
+}
+
+func sortedLeaves(dag *dagrid.Dag) []int {
+	leaves := make([]int, 0, len(dag.Leaves))
+	for leaf_index := range dag.Leaves {
+		leaves = append(leaves, leaf_index)
+	}
+	sort.Ints(leaves)
+	return leaves
+}
+
+// dropStaleLeaves removes any node that has children from the dag's Leaves
+func dropStaleLeaves(dag *dagrid.Dag) {
+	for leaf_index := range dag.Leaves {
+		if len(dag.Nodes[leaf_index].Children) > 0 {
+			delete(dag.Leaves, leaf_index)
+		}
+	}
+}
+
+// recomputeLeaves rebuilds the dag's Leaves from scratch, so it holds exactly
+// the nodes with no children. Indices are unchanged.
+// TODO: move this to package dagrid as Dag.RecomputeLeaves
+func recomputeLeaves(dag *dagrid.Dag) {
+	rebuildDag(dag, func(int) bool { return true })
+}
+
+// rebuildDag replaces the dag with a copy holding only the nodes keep returns
+// true for, and the edges between them. Nodes keep their relative order, so
+// if every node is kept the indices are unchanged. The returned map translates
+// old indices to new ones.
+//
+// Leaves can only be added to by inserting a node, so rebuilding is how they
+// are recomputed.
+func rebuildDag(dag *dagrid.Dag, keep func(index int) bool) map[int]int {
+	newdag := dagrid.New_dag()
+
+	// form: index_map[old_index]new_index
+	index_map := make(map[int]int)
+
+	for old_index := 0; old_index < len(dag.Nodes); old_index++ {
+		if !keep(old_index) {
+			continue
+		}
+		index_map[old_index] = newdag.Insert_free_node(dag.Nodes[old_index].Contents)
+	}
+
+	for old_index := 0; old_index < len(dag.Nodes); old_index++ {
+		new_parent, ok := index_map[old_index]
+		if !ok {
+			continue
+		}
+
+		for child := range dag.Nodes[old_index].Children {
+			new_child, ok := index_map[child]
+			if ok {
+				newdag.Add_edge(new_parent, new_child)
+			}
+		}
+	}
+
+	// every node went in as a free node, so anything that gained a child
+	// shouldn't be a leaf anymore
+	dropStaleLeaves(&newdag)
+
+	*dag = newdag
+	return index_map
+}
+
+// removeNode removes the node at index from the dag, detaching it from all its
+// parents and children. Every other edge is kept, so paths that don't pass
+// through the removed node (e.g. the other side of a diamond) stay intact.
+// A parent left with no children becomes a leaf.
+//
+// The dag is rebuilt rather than tombstoned, so the remaining nodes are
+// reindexed. The returned map translates old indices to new ones, so indices
+// held elsewhere can be updated. The removed node has no entry in it.
+//
+// TODO: move this to package dagrid as Dag.Remove_node
+func removeNode(dag *dagrid.Dag, index int) map[int]int {
+	return rebuildDag(dag, func(old_index int) bool { return old_index != index })
+}
+
+// dagRoots returns the sorted indices of the nodes with no parents, the tests
+// nothing else depends on
+// TODO: move this to package dagrid as Dag.Roots
+func dagRoots(dag *dagrid.Dag) []int {
+	var roots []int
+	for index := 0; index < len(dag.Nodes); index++ {
+		if len(dag.Nodes[index].Parents) == 0 {
+			roots = append(roots, index)
+		}
+	}
+
+	return roots
+}
+
+// nodeLevels returns the level of every node in the dag, the length of the
+// longest path from it down to a leaf. Leaves are level 0, and all the nodes
+// in a level can run in parallel once the levels below it are done.
+// form: levels[node_index]level
+func nodeLevels(dag *dagrid.Dag) map[int]int {
+	levels := make(map[int]int)
+
+	var levelOf func(index int) int
+	levelOf = func(index int) int {
+		if level, ok := levels[index]; ok {
+			return level
+		}
+
+		level := 0
+		for child := range dag.Nodes[index].Children {
+			if child_level := levelOf(child) + 1; child_level > level {
+				level = child_level
+			}
+		}
+
+		levels[index] = level
+		return level
+	}
+
+	for index := 0; index < len(dag.Nodes); index++ {
+		levelOf(index)
+	}
+
+	return levels
+}
+
+// dagDepth returns the number of nodes on the longest path through the dag,
+// i.e. its critical path
+// TODO: move this to package dagrid as Dag.Depth
+func dagDepth(dag *dagrid.Dag) int {
+	depth := 0
+	for _, level := range nodeLevels(dag) {
+		if level+1 > depth {
+			depth = level + 1
+		}
+	}
+
+	return depth
+}
+
+// dagMaxWidth returns the largest number of nodes in any one level of the
+// dag, i.e. the most tests that can run at once
+// TODO: move this to package dagrid as Dag.MaxWidth
+func dagMaxWidth(dag *dagrid.Dag) int {
+	// form: widths[level]width
+	widths := make(map[int]int)
+	max_width := 0
+
+	for _, level := range nodeLevels(dag) {
+		widths[level]++
+		if widths[level] > max_width {
+			max_width = widths[level]
+		}
+	}
+
+	return max_width
+}
+
+// dagEdges returns the set of edges in the dag as [parent, child] name pairs,
+// so that edges can be compared between dags with different numbering
+func dagEdges(dag *dagrid.Dag) map[[2]string]bool {
+	edges := make(map[[2]string]bool)
+
+	for index := 0; index < len(dag.Nodes); index++ {
+		for child := range dag.Nodes[index].Children {
+			edges[[2]string{dag.Nodes[index].Contents, dag.Nodes[child].Contents}] = true
+		}
+	}
+
+	return edges
+}
+
+// dagDiff compares two dags by node name, returning what would have to be
+// added to and removed from a to get b. All results are sorted.
+// TODO: move this to package dagrid as Diff
+func dagDiff(a *dagrid.Dag, b *dagrid.Dag) (added_nodes, removed_nodes []string, added_edges, removed_edges [][2]string) {
+	for name := range b.IndexLookup {
+		if _, ok := a.IndexLookup[name]; !ok {
+			added_nodes = append(added_nodes, name)
+		}
+	}
+	for name := range a.IndexLookup {
+		if _, ok := b.IndexLookup[name]; !ok {
+			removed_nodes = append(removed_nodes, name)
+		}
+	}
+	sort.Strings(added_nodes)
+	sort.Strings(removed_nodes)
+
+	a_edges := dagEdges(a)
+	b_edges := dagEdges(b)
+
+	for edge := range b_edges {
+		if !a_edges[edge] {
+			added_edges = append(added_edges, edge)
+		}
+	}
+	for edge := range a_edges {
+		if !b_edges[edge] {
+			removed_edges = append(removed_edges, edge)
+		}
+	}
+	sortEdges(added_edges)
+	sortEdges(removed_edges)
+
+	return added_nodes, removed_nodes, added_edges, removed_edges
+}
+
+// dagDiffString formats what dagDiff finds between a and b one change per
+// line, like a diff: "+ test7" for an added test, "- test1 -> test3" for a
+// removed edge. It is empty if the dags are the same.
+func dagDiffString(a *dagrid.Dag, b *dagrid.Dag) string {
+	added_nodes, removed_nodes, added_edges, removed_edges := dagDiff(a, b)
+
+	var out strings.Builder
+	for _, name := range removed_nodes {
+		fmt.Fprintf(&out, "- %s\n", name)
+	}
+	for _, name := range added_nodes {
+		fmt.Fprintf(&out, "+ %s\n", name)
+	}
+	for _, edge := range removed_edges {
+		fmt.Fprintf(&out, "- %s -> %s\n", edge[0], edge[1])
+	}
+	for _, edge := range added_edges {
+		fmt.Fprintf(&out, "+ %s -> %s\n", edge[0], edge[1])
+	}
+
+	return out.String()
+}
+
+func sortEdges(edges [][2]string) {
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+}
+
+// dagEqual reports whether two dags have the same nodes and edges, regardless
+// of the order they were inserted in
+// TODO: move this to package dagrid as Dag.Equal
+func dagEqual(a *dagrid.Dag, b *dagrid.Dag) bool {
+	added_nodes, removed_nodes, added_edges, removed_edges := dagDiff(a, b)
+
+	return len(added_nodes) == 0 && len(removed_nodes) == 0 &&
+		len(added_edges) == 0 && len(removed_edges) == 0
+}
+
+// rootDistances returns, for every node in the dag, the number of nodes on the
+// longest path from it up to a root, including itself. Roots are 1. Running
+// the nodes with the largest distance first shortens the critical path.
+// form: distances[node_index]distance
+func rootDistances(dag *dagrid.Dag) map[int]int {
+	distances := make(map[int]int)
+
+	var distanceOf func(index int) int
+	distanceOf = func(index int) int {
+		if distance, ok := distances[index]; ok {
+			return distance
+		}
+
+		distance := 1
+		for parent := range dag.Nodes[index].Parents {
+			if parent_distance := distanceOf(parent) + 1; parent_distance > distance {
+				distance = parent_distance
+			}
+		}
+
+		distances[index] = distance
+		return distance
+	}
+
+	for index := 0; index < len(dag.Nodes); index++ {
+		distanceOf(index)
+	}
+
+	return distances
+}
+
+// insertChildByName inserts a new node called child below the node called
+// parent, so dags can be built without keeping track of indices
+// TODO: move this to package dagrid as Dag.Insert_child_by_name
+func insertChildByName(dag *dagrid.Dag, parent string, child string) error {
+	parent_index, ok := dag.IndexLookup[parent]
+	if !ok {
+		return fmt.Errorf("parent %q not found in dag", parent)
+	}
+	if _, ok := dag.IndexLookup[child]; ok {
+		return fmt.Errorf("%q is already in the dag", child)
+	}
+
+	dag.Insert_child(parent_index, child)
+	return nil
+}
+
+// addEdgeByName adds an edge from the node called parent to the node called
+// child, both of which must already be in the dag
+// TODO: move this to package dagrid as Dag.Add_edge_by_name
+func addEdgeByName(dag *dagrid.Dag, parent string, child string) error {
+	parent_index, ok := dag.IndexLookup[parent]
+	if !ok {
+		return fmt.Errorf("parent %q not found in dag", parent)
+	}
+	child_index, ok := dag.IndexLookup[child]
+	if !ok {
+		return fmt.Errorf("child %q not found in dag", child)
+	}
+
+	dag.Add_edge(parent_index, child_index)
+
+	// Add_edge doesn't update Leaves, and parent may have been one
+	recomputeLeaves(dag)
+	return nil
+}
+
+// dagLevels groups the names of the nodes in the dag by level, with the
+// names in each level sorted. levels[0] are the leaves.
+// form: levels[level][]node_name
+func dagLevels(dag *dagrid.Dag) [][]string {
+	var levels [][]string
+	for index, level := range nodeLevels(dag) {
+		for len(levels) <= level {
+			levels = append(levels, nil)
+		}
+		levels[level] = append(levels[level], dag.Nodes[index].Contents)
+	}
+
+	for _, level := range levels {
+		sort.Strings(level)
+	}
+
+	return levels
+}
+
+// dagAncestors returns the sorted indices of every node above the node at
+// index, i.e. every test that depends on it directly or indirectly
+// TODO: move this to package dagrid as Dag.Ancestors
+func dagAncestors(dag *dagrid.Dag, index int) []int {
+	visited := make(map[int]bool)
+
+	var visit func(index int)
+	visit = func(index int) {
+		for parent := range dag.Nodes[index].Parents {
+			if !visited[parent] {
+				visited[parent] = true
+				visit(parent)
+			}
+		}
+	}
+	visit(index)
+
+	ancestors := make([]int, 0, len(visited))
+	for ancestor := range visited {
+		ancestors = append(ancestors, ancestor)
+	}
+	sort.Ints(ancestors)
+
+	return ancestors
+}
+
+// keepChanged cuts the dag down to the changed nodes and their ancestors, the
+// only tests whose results can differ once the changed tests are. The nodes
+// below them keep their previous results, so the changed nodes become leaves.
+func keepChanged(dag *dagrid.Dag, changed []string) error {
+	keep := make(map[int]bool)
+	for _, name := range changed {
+		index, ok := dag.IndexLookup[name]
+		if !ok {
+			return fmt.Errorf("changed test %q is not part of the validation", name)
+		}
+
+		keep[index] = true
+		for _, ancestor := range dagAncestors(dag, index) {
+			keep[ancestor] = true
+		}
+	}
+
+	rebuildDag(dag, func(index int) bool { return keep[index] })
+	return nil
+}
+
+// insertParent inserts a new node with contents above the node at child, the
+// inverse of Insert_child, and returns its index. Dags built bottom-up with
+// this come out the same as ones built top-down with Insert_child.
+// TODO: move this to package dagrid as Dag.Insert_parent
+func insertParent(dag *dagrid.Dag, child int, contents string) int {
+	parent := dag.Insert_free_node(contents)
+	dag.Add_edge(parent, child)
+
+	// it went in as a free node, but now has a child
+	recomputeLeaves(dag)
+
+	return parent
+}
+
+// dagDescendants returns the sorted indices of every node below the node at
+// index, i.e. every test it depends on directly or indirectly
+// TODO: move this to package dagrid as Dag.Descendants
+func dagDescendants(dag *dagrid.Dag, index int) []int {
+	visited := make(map[int]bool)
+
+	var visit func(index int)
+	visit = func(index int) {
+		for child := range dag.Nodes[index].Children {
+			if !visited[child] {
+				visited[child] = true
+				visit(child)
+			}
+		}
+	}
+	visit(index)
+
+	descendants := make([]int, 0, len(visited))
+	for descendant := range visited {
+		descendants = append(descendants, descendant)
+	}
+	sort.Ints(descendants)
+
+	return descendants
+}
+
+// dagString formats the dag compactly for logging, as each test in name order
+// followed by the tests it depends on, e.g. "test4 -> test6; test6"
+func dagString(dag *dagrid.Dag) string {
+	names := make([]string, 0, len(dag.Nodes))
+	for name := range dag.IndexLookup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		var children []string
+		for _, child := range sortedChildren(dag, dag.IndexLookup[name]) {
+			children = append(children, dag.Nodes[child].Contents)
+		}
+		sort.Strings(children)
+
+		if len(children) == 0 {
+			parts = append(parts, name)
+		} else {
+			parts = append(parts, name+" -> "+strings.Join(children, ", "))
+		}
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// checkDag looks for mistakes in a dag that would otherwise only show up as
+// hangs or wrong scheduling when validations run: names that don't match
+// their nodes, edges to nodes that don't exist or only go one way, stale
+// Leaves, and cycles
+func checkDag(dag *dagrid.Dag) error {
+	if len(dag.IndexLookup) != len(dag.Nodes) {
+		return fmt.Errorf("dag has %d nodes but %d names, some test is defined twice", len(dag.Nodes), len(dag.IndexLookup))
+	}
+	for name, index := range dag.IndexLookup {
+		if index < 0 || index >= len(dag.Nodes) || dag.Nodes[index].Contents != name {
+			return fmt.Errorf("test %s is looked up at the wrong node", name)
+		}
+	}
+
+	for index := 0; index < len(dag.Nodes); index++ {
+		name := dag.Nodes[index].Contents
+		for child := range dag.Nodes[index].Children {
+			if child < 0 || child >= len(dag.Nodes) {
+				return fmt.Errorf("test %s depends on missing node %d", name, child)
+			}
+			if _, ok := dag.Nodes[child].Parents[index]; !ok {
+				return fmt.Errorf("test %s depends on %s, but isn't one of its parents", name, dag.Nodes[child].Contents)
+			}
+		}
+		for parent := range dag.Nodes[index].Parents {
+			if parent < 0 || parent >= len(dag.Nodes) {
+				return fmt.Errorf("test %s has missing parent node %d", name, parent)
+			}
+			if _, ok := dag.Nodes[parent].Children[index]; !ok {
+				return fmt.Errorf("test %s has parent %s, which doesn't depend on it", name, dag.Nodes[parent].Contents)
+			}
+		}
+
+		// leaves are where validations start, so a missing one is never
+		// run, and neither is anything above it
+		_, is_leaf := dag.Leaves[index]
+		if is_leaf && len(dag.Nodes[index].Children) > 0 {
+			return fmt.Errorf("test %s is marked as a leaf, but depends on other tests", name)
+		}
+		if !is_leaf && len(dag.Nodes[index].Children) == 0 {
+			return fmt.Errorf("test %s depends on no other tests, but isn't marked as a leaf", name)
+		}
+	}
+
+	// depth first search, looking for an edge back to a node that is still
+	// being visited
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make([]int, len(dag.Nodes))
+	var path []string
+
+	var visit func(index int) error
+	visit = func(index int) error {
+		state[index] = visiting
+		path = append(path, dag.Nodes[index].Contents)
+
+		for _, child := range sortedChildren(dag, index) {
+			switch state[child] {
+			case visiting:
+				// the cycle is the part of the path from child onwards
+				start := 0
+				for path[start] != dag.Nodes[child].Contents {
+					start++
+				}
+				cycle := append(append([]string{}, path[start:]...), dag.Nodes[child].Contents)
+				return fmt.Errorf("dag has a cycle: %s", strings.Join(cycle, " -> "))
+			case unvisited:
+				if err := visit(child); err != nil {
+					return err
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[index] = done
+		return nil
+	}
+	for index := 0; index < len(dag.Nodes); index++ {
+		if state[index] == unvisited {
+			if err := visit(index); err != nil {
+				return err
+			}
+		}
+	}
+
+	// with no cycles every node is below some root, but check anyway, since
+	// a node no root reaches would never be part of a subdag's traversal
+	reached := make(map[int]bool)
+	for _, root := range dagRoots(dag) {
+		reached[root] = true
+		for _, descendant := range dagDescendants(dag, root) {
+			reached[descendant] = true
+		}
+	}
+	for index := 0; index < len(dag.Nodes); index++ {
+		if !reached[index] {
+			return fmt.Errorf("test %s can't be reached from any root", dag.Nodes[index].Contents)
+		}
+	}
+
+	return nil
+}
+
+// dagDot formats the dag as a Graphviz DOT graph, with an edge from each test
+// to each test it depends on. Tests and edges are sorted, so the same dag
+// always gives the same output.
+func dagDot(dag *dagrid.Dag) string {
+	names := make([]string, 0, len(dag.IndexLookup))
+	for name := range dag.IndexLookup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var edges [][2]string
+	for edge := range dagEdges(dag) {
+		edges = append(edges, edge)
+	}
+	sortEdges(edges)
+
+	return rovecore.Dot(names, edges)
+}
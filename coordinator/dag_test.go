@@ -0,0 +1,238 @@
+package coordinator
+
+import (
+	"github.com/intarga/dagrid"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDagDiffString(t *testing.T) {
+	old := constructDag()
+	config := pipelineConfig{Tests: []testConfig{
+		{Name: "test1", DependsOn: []string{"test2", "test7"}},
+		{Name: "test2", DependsOn: []string{"test4"}},
+		{Name: "test4", DependsOn: []string{"test6"}},
+		{Name: "test6"},
+		{Name: "test7", DependsOn: []string{"test6"}},
+	}}
+	updated, _, err := buildPipeline(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "- test3\n" +
+		"- test5\n" +
+		"+ test7\n" +
+		"- test1 -> test3\n" +
+		"- test3 -> test5\n" +
+		"- test5 -> test6\n" +
+		"+ test1 -> test7\n" +
+		"+ test7 -> test6\n"
+	if diff := dagDiffString(&old, &updated); diff != expected {
+		t.Errorf("diff is\n%s\nexpected\n%s", diff, expected)
+	}
+
+	if diff := dagDiffString(&old, &old); diff != "" {
+		t.Errorf("diff of a dag with itself is\n%s\nexpected nothing", diff)
+	}
+}
+
+func TestDagEqual(t *testing.T) {
+	top_down := constructDag()
+
+	// the same dag, with the nodes inserted leaves first
+	bottom_up := dagrid.New_dag()
+	for _, name := range []string{"test6", "test5", "test4", "test3", "test2", "test1"} {
+		bottom_up.Insert_free_node(name)
+	}
+	for _, edge := range [][2]string{
+		{"test5", "test6"}, {"test4", "test6"},
+		{"test3", "test5"}, {"test2", "test4"},
+		{"test1", "test3"}, {"test1", "test2"},
+	} {
+		if err := addEdgeByName(&bottom_up, edge[0], edge[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if top_down.IndexLookup["test1"] == bottom_up.IndexLookup["test1"] {
+		t.Fatal("test1 has the same index in both dags, so this doesn't test ignoring indices")
+	}
+
+	if !dagEqual(&top_down, &bottom_up) || !dagEqual(&bottom_up, &top_down) {
+		t.Errorf("dags built in different orders aren't equal:\n%s\n%s", dagString(&top_down), dagString(&bottom_up))
+	}
+
+	extra_node := constructDag()
+	extra_node.Insert_free_node("test7")
+	if dagEqual(&top_down, &extra_node) {
+		t.Error("dags with different tests are equal")
+	}
+
+	extra_edge := constructDag()
+	if err := addEdgeByName(&extra_edge, "test1", "test6"); err != nil {
+		t.Fatal(err)
+	}
+	if dagEqual(&top_down, &extra_edge) {
+		t.Error("dags with different edges are equal")
+	}
+}
+
+func TestInsertParentMatchesInsertChild(t *testing.T) {
+	top_down := constructDag()
+
+	// the same dag, built up from test6
+	bottom_up := dagrid.New_dag()
+	test6 := bottom_up.Insert_free_node("test6")
+	test4 := insertParent(&bottom_up, test6, "test4")
+	test5 := insertParent(&bottom_up, test6, "test5")
+	test2 := insertParent(&bottom_up, test4, "test2")
+	test3 := insertParent(&bottom_up, test5, "test3")
+	test1 := insertParent(&bottom_up, test2, "test1")
+	if err := addEdgeByName(&bottom_up, "test1", "test3"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkDag(&bottom_up); err != nil {
+		t.Fatal(err)
+	}
+	if !dagEqual(&top_down, &bottom_up) {
+		t.Errorf("dag built with insertParent is\n%s\nexpected\n%s", dagString(&bottom_up), dagString(&top_down))
+	}
+	if leaves := leafNames(&bottom_up); !reflect.DeepEqual(leaves, []string{"test6"}) {
+		t.Errorf("leaves are %v, expected [test6]", leaves)
+	}
+	for name, index := range map[string]int{"test1": test1, "test2": test2, "test3": test3, "test4": test4, "test5": test5, "test6": test6} {
+		if bottom_up.IndexLookup[name] != index {
+			t.Errorf("%s is looked up at %d, but was inserted at %d", name, bottom_up.IndexLookup[name], index)
+		}
+	}
+}
+
+// leafNames returns the sorted names of the dag's leaves
+func leafNames(dag *dagrid.Dag) []string {
+	var names []string
+	for _, leaf := range sortedLeaves(dag) {
+		names = append(names, dag.Nodes[leaf].Contents)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestAddEdgeUpdatesLeaves(t *testing.T) {
+	dag := dagrid.New_dag()
+	dag.Insert_free_node("parent")
+	dag.Insert_free_node("child")
+
+	if err := addEdgeByName(&dag, "parent", "child"); err != nil {
+		t.Fatal(err)
+	}
+
+	if leaves := leafNames(&dag); !reflect.DeepEqual(leaves, []string{"child"}) {
+		t.Errorf("leaves are %v after adding an edge from a former leaf, expected [child]", leaves)
+	}
+	if err := checkDag(&dag); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRebuildDagUpdatesLeaves(t *testing.T) {
+	dag := constructDag()
+	test6 := dag.IndexLookup["test6"]
+
+	rebuildDag(&dag, func(index int) bool { return index != test6 })
+
+	if leaves := leafNames(&dag); !reflect.DeepEqual(leaves, []string{"test4", "test5"}) {
+		t.Errorf("leaves are %v after removing test6, expected [test4 test5]", leaves)
+	}
+	if err := checkDag(&dag); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRemoveNodeKeepsOtherPaths(t *testing.T) {
+	dag := constructDag()
+	test3 := dag.IndexLookup["test3"]
+
+	index_map := removeNode(&dag, test3)
+
+	if _, ok := dag.IndexLookup["test3"]; ok {
+		t.Error("test3 can still be looked up after being removed")
+	}
+	if _, ok := index_map[test3]; ok {
+		t.Error("test3 has an entry in the index map after being removed")
+	}
+	expected := map[[2]string]bool{
+		{"test1", "test2"}: true,
+		{"test2", "test4"}: true,
+		{"test4", "test6"}: true,
+		{"test5", "test6"}: true,
+	}
+	if edges := dagEdges(&dag); !reflect.DeepEqual(edges, expected) {
+		t.Errorf("edges are %v after removing test3, expected %v", edges, expected)
+	}
+	if leaves := leafNames(&dag); !reflect.DeepEqual(leaves, []string{"test6"}) {
+		t.Errorf("leaves are %v after removing test3, expected [test6]", leaves)
+	}
+	if err := checkDag(&dag); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDagLevels(t *testing.T) {
+	dag := constructDag()
+	expected := [][]string{{"test6"}, {"test4", "test5"}, {"test2", "test3"}, {"test1"}}
+	if levels := dagLevels(&dag); !reflect.DeepEqual(levels, expected) {
+		t.Errorf("levels are %v, expected %v", levels, expected)
+	}
+
+	// a node's level is set by its longest path down, so a leaf under the
+	// root stays in level 0
+	config := pipelineConfig{Tests: []testConfig{
+		{Name: "test1", DependsOn: []string{"test2", "test3"}},
+		{Name: "test2"},
+		{Name: "test3", DependsOn: []string{"test4"}},
+		{Name: "test4"},
+	}}
+	uneven, _, err := buildPipeline(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = [][]string{{"test2", "test4"}, {"test3"}, {"test1"}}
+	if levels := dagLevels(&uneven); !reflect.DeepEqual(levels, expected) {
+		t.Errorf("levels are %v, expected %v", levels, expected)
+	}
+}
+
+func TestInsertParentUpdatesLeaves(t *testing.T) {
+	dag := dagrid.New_dag()
+	child := dag.Insert_free_node("child")
+
+	insertParent(&dag, child, "parent")
+
+	if leaves := leafNames(&dag); !reflect.DeepEqual(leaves, []string{"child"}) {
+		t.Errorf("leaves are %v after inserting a parent, expected [child]", leaves)
+	}
+	if err := checkDag(&dag); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecomputeLeaves(t *testing.T) {
+	dag := constructDag()
+	indices := make(map[string]int)
+	for name, index := range dag.IndexLookup {
+		indices[name] = index
+	}
+
+	// lose track of the only leaf
+	delete(dag.Leaves, dag.IndexLookup["test6"])
+	recomputeLeaves(&dag)
+
+	if leaves := leafNames(&dag); !reflect.DeepEqual(leaves, []string{"test6"}) {
+		t.Errorf("leaves are %v after recomputing, expected [test6]", leaves)
+	}
+	if !reflect.DeepEqual(dag.IndexLookup, indices) {
+		t.Errorf("indices changed from %v to %v", indices, dag.IndexLookup)
+	}
+}
@@ -0,0 +1,103 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DataSource fetches observations, so tests can run on their values when the
+// client didn't send them
+type DataSource interface {
+	// Fetch returns the values observed for the data at t. A zero t means the
+	// latest observation. If there is no observation, the error matches
+	// errNoObservation with errors.Is, so it can be told apart from the
+	// source being unavailable.
+	Fetch(ctx context.Context, data_id uint32, station_id uint32, t time.Time) ([]float64, error)
+}
+
+// errNoObservation is returned by DataSource.Fetch when the source works, but
+// has nothing observed for the data at that time
+var errNoObservation = errors.New("no observation")
+
+// frostSource fetches observations of a single element from the Frost API.
+// Frost has no notion of our DataIds, so observations are looked up by station
+// and time.
+type frostSource struct {
+	client   *http.Client
+	baseUrl  string
+	clientId string
+	element  string
+}
+
+func newFrostSource(base_url string, client_id string, element string) *frostSource {
+	return &frostSource{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		baseUrl:  base_url,
+		clientId: client_id,
+		element:  element,
+	}
+}
+
+// frostResponse is the part of Frost's observations response we use
+type frostResponse struct {
+	Data []struct {
+		Observations []struct {
+			Value float64 `json:"value"`
+		} `json:"observations"`
+	} `json:"data"`
+}
+
+func (source *frostSource) Fetch(ctx context.Context, data_id uint32, station_id uint32, t time.Time) ([]float64, error) {
+	reference_time := "latest"
+	if !t.IsZero() {
+		reference_time = t.UTC().Format(time.RFC3339)
+	}
+
+	query := url.Values{}
+	query.Set("sources", fmt.Sprintf("SN%d", station_id))
+	query.Set("elements", source.element)
+	query.Set("referencetime", reference_time)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.baseUrl+"/observations/v0.jsonld?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// frost takes the client id as the basic auth username, with no password
+	req.SetBasicAuth(source.clientId, "")
+
+	resp, err := source.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// frost gives 404 rather than an empty result when nothing was observed
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: frost has no %s observations for station %d at %s", errNoObservation, source.element, station_id, reference_time)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("frost returned %s for station %d at %s", resp.Status, station_id, reference_time)
+	}
+
+	var body frostResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("cannot decode frost response: %v", err)
+	}
+
+	var values []float64
+	for _, data := range body.Data {
+		for _, observation := range data.Observations {
+			values = append(values, observation.Value)
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%w: frost has no %s observations for station %d at %s", errNoObservation, source.element, station_id, reference_time)
+	}
+
+	return values, nil
+}
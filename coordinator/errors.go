@@ -0,0 +1,54 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"github.com/metno/rove/internal/rovecore"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+// unknownTestsError is returned when a request names tests that aren't in the
+// dag
+type unknownTestsError struct {
+	tests []string
+	// form: suggestions[test]close_matches
+	suggestions map[string][]string
+}
+
+func (e *unknownTestsError) Error() string {
+	messages := make([]string, len(e.tests))
+	for i, test := range e.tests {
+		messages[i] = fmt.Sprintf("required test %q not found in dag%s", test, didYouMean(e.suggestions[test]))
+	}
+
+	return strings.Join(messages, "; ")
+}
+
+// invalidArgument turns err into an InvalidArgument status. If err is one the
+// client could act on programmatically, the status carries an ErrorInfo
+// detail describing it, so the client doesn't have to parse the message.
+// Errors that already have a status, like internal ones, are returned as is.
+func invalidArgument(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	st := status.New(codes.InvalidArgument, err.Error())
+
+	var unknown *unknownTestsError
+	if errors.As(err, &unknown) {
+		detailed, detail_err := st.WithDetails(&errdetails.ErrorInfo{
+			Reason:   rovecore.ReasonUnknownTests,
+			Domain:   rovecore.ErrorDomain,
+			Metadata: map[string]string{"tests": strings.Join(unknown.tests, ",")},
+		})
+		if detail_err == nil {
+			st = detailed
+		}
+	}
+
+	return st.Err()
+}
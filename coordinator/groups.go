@@ -0,0 +1,60 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// expandGroups replaces every "@group" in tests with the names of the tests
+// in that group, in alphabetical order. Plain test names are passed through
+// untouched, and each test appears only once in the result, however many
+// times it was named.
+//
+// The dependencies of the group's tests aren't added here, constructSubDag
+// takes care of those as it would for any other test.
+func expandGroups(info map[string]testInfo, tests []string) ([]string, error) {
+	expanded := make([]string, 0, len(tests))
+	seen := make(map[string]bool)
+
+	add := func(test string) {
+		if !seen[test] {
+			seen[test] = true
+			expanded = append(expanded, test)
+		}
+	}
+
+	for _, test := range tests {
+		if !strings.HasPrefix(test, "@") {
+			add(test)
+			continue
+		}
+
+		members := groupMembers(info, strings.TrimPrefix(test, "@"))
+		if len(members) == 0 {
+			return nil, fmt.Errorf("unknown test group %q", test)
+		}
+		for _, member := range members {
+			add(member)
+		}
+	}
+
+	return expanded, nil
+}
+
+// groupMembers returns the sorted names of the tests in group
+func groupMembers(info map[string]testInfo, group string) []string {
+	var members []string
+
+	for test, test_info := range info {
+		for _, test_group := range test_info.groups {
+			if test_group == group {
+				members = append(members, test)
+				break
+			}
+		}
+	}
+	sort.Strings(members)
+
+	return members
+}
@@ -0,0 +1,39 @@
+package coordinator
+
+import (
+	"context"
+	pb "github.com/metno/rove/proto"
+	"time"
+)
+
+// startHeartbeats sends a heartbeat response on the stream every interval, so
+// the client and any proxies in between can tell it is still alive while slow
+// tests run. The returned function stops the heartbeats, and only returns once
+// none are being sent. It can be called more than once.
+func startHeartbeats(ctx context.Context, interval time.Duration, sender *queuedSender) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := sender.Send(&pb.ValidateResponse{Heartbeat: true}); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,84 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/metno/rove/proto"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"strconv"
+)
+
+// kafkaSink publishes results to a kafka topic as they are produced. Messages
+// are keyed by DataId, so all flags for an observation land on the same
+// partition in order.
+//
+// Publishing is asynchronous. Delivery failures are logged, but never affect
+// the validation itself.
+type kafkaSink struct {
+	writer *kafka.Writer
+	encode func(*pb.ValidateResponse) ([]byte, error)
+}
+
+// newKafkaSink sets up a sink publishing to topic on the given brokers.
+// encoding is either "proto" for the binary protobuf encoding of
+// ValidateResponse, or "json" for its protojson encoding.
+func newKafkaSink(brokers []string, topic string, encoding string) (*kafkaSink, error) {
+	var encode func(*pb.ValidateResponse) ([]byte, error)
+	switch encoding {
+	case "proto":
+		encode = func(resp *pb.ValidateResponse) ([]byte, error) { return proto.Marshal(resp) }
+	case "json":
+		encode = func(resp *pb.ValidateResponse) ([]byte, error) { return protojson.Marshal(resp) }
+	default:
+		return nil, fmt.Errorf("unknown kafka encoding %q, expected proto or json", encoding)
+	}
+
+	writer := &kafka.Writer{
+		Addr:     kafka.TCP(brokers...),
+		Topic:    topic,
+		Balancer: &kafka.Hash{},
+		Async:    true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Printf("failed to publish %d results to kafka: %v", len(messages), err)
+			}
+		},
+	}
+
+	return &kafkaSink{writer: writer, encode: encode}, nil
+}
+
+// message builds the kafka message for res, keyed by the data it is about
+func (sink *kafkaSink) message(res Result) (kafka.Message, error) {
+	value, err := sink.encode(res.Resp)
+	if err != nil {
+		return kafka.Message{}, err
+	}
+
+	return kafka.Message{
+		Key:     []byte(strconv.FormatUint(uint64(res.Resp.DataId), 10)),
+		Value:   value,
+		Time:    res.Time,
+		Headers: []kafka.Header{{Key: "request_id", Value: []byte(res.RequestId)}},
+	}, nil
+}
+
+func (sink *kafkaSink) Write(res Result) {
+	message, err := sink.message(res)
+	if err != nil {
+		log.Printf("failed to encode result for request %s: %v", res.RequestId, err)
+		return
+	}
+
+	err = sink.writer.WriteMessages(context.Background(), message)
+	if err != nil {
+		log.Printf("failed to queue result for request %s for kafka: %v", res.RequestId, err)
+	}
+}
+
+func (sink *kafkaSink) Close() error {
+	return sink.writer.Close()
+}
@@ -0,0 +1,37 @@
+package coordinator
+
+import (
+	"context"
+	pb "github.com/metno/rove/proto"
+	"testing"
+)
+
+func TestKafkaMessagesKeyedByDataId(t *testing.T) {
+	stubTests(t, map[string]testFunc{"test4": passingTest, "test6": passingTest})
+
+	sink := &collectingSink{}
+	s := newTestServer()
+	s.sinks = []ResultSink{sink}
+
+	_, err := s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: 42, Tests: []string{"test4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.results) != 2 {
+		t.Fatalf("sink got %d results, expected one for each of test4 and test6", len(sink.results))
+	}
+
+	kafka, err := newKafkaSink([]string{"localhost:9092"}, "qc-flags", "proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range sink.results {
+		message, err := kafka.message(res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(message.Key) != "42" {
+			t.Errorf("flag %d keyed by %q, expected the request's data id 42", res.Resp.FlagId, message.Key)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package coordinator
+
+import (
+	"context"
+	pb "github.com/metno/rove/proto"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// rateLimitInterceptor rejects streams started faster than limiter allows with
+// ResourceExhausted, before any work is done for them. The streaming RPCs,
+// ValidateOne, ValidateSeries and ValidateSpatial, are the ones that run
+// tests, so they are what gets limited.
+func rateLimitInterceptor(limiter *rate.Limiter) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !limiter.Allow() {
+			return status.Error(codes.ResourceExhausted, "too many validation requests, try again later")
+		}
+
+		return handler(srv, ss)
+	}
+}
+
+// validateOneSyncMethod is ValidateOneSync's full method name, as unary
+// interceptors see it
+var validateOneSyncMethod = "/" + pb.Coordinator_ServiceDesc.ServiceName + "/ValidateOneSync"
+
+// rateLimitUnaryInterceptor is rateLimitInterceptor for ValidateOneSync,
+// sharing its limiter. Other unary RPCs aren't limited, since they don't run
+// tests.
+func rateLimitUnaryInterceptor(limiter *rate.Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == validateOneSyncMethod && !limiter.Allow() {
+			return nil, status.Error(codes.ResourceExhausted, "too many validation requests, try again later")
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// validationLimiter caps how many validations run at once. A validation over
+// the cap waits for a slot, unless too many are already waiting, in which case
+// it is rejected.
+type validationLimiter struct {
+	slots chan struct{}
+	queue chan struct{}
+}
+
+func newValidationLimiter(max_running int, max_queued int) *validationLimiter {
+	return &validationLimiter{
+		slots: make(chan struct{}, max_running),
+		queue: make(chan struct{}, max_queued),
+	}
+}
+
+// acquire blocks until the validation can run, returning a grpc status error
+// if it is rejected or ctx ends first. release must be called once the
+// validation is done if acquire succeeded.
+func (l *validationLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return status.Error(codes.ResourceExhausted, "too many validations running, try again later")
+	}
+	defer func() { <-l.queue }()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (l *validationLimiter) release() {
+	<-l.slots
+}
+
+// testLimiter caps how many tests run at once across all validations. Tests
+// over the cap wait for a slot, first come first served, so a burst of
+// validations slows down evenly rather than swamping whatever the tests run
+// against. --max-concurrent-tests keeps a single wide validation from
+// taking up the whole queue.
+type testLimiter struct {
+	mutex sync.Mutex
+	free  int
+	// tests waiting for a slot, oldest first. a waiter's channel is closed
+	// when it is given one
+	waiting []chan struct{}
+}
+
+func newTestLimiter(max_running int) *testLimiter {
+	return &testLimiter{free: max_running}
+}
+
+// acquire blocks until the test can run, or returns ctx's error if it ends
+// first. release must be called once the test is done if acquire succeeded.
+func (l *testLimiter) acquire(ctx context.Context) error {
+	l.mutex.Lock()
+	if l.free > 0 && len(l.waiting) == 0 {
+		l.free--
+		l.mutex.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	l.waiting = append(l.waiting, ready)
+	l.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for i, waiter := range l.waiting {
+		if waiter == ready {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return ctx.Err()
+		}
+	}
+
+	// given a slot just as ctx ended, so pass it on
+	l.releaseLocked()
+	return ctx.Err()
+}
+
+func (l *testLimiter) release() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.releaseLocked()
+}
+
+func (l *testLimiter) releaseLocked() {
+	if len(l.waiting) > 0 {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		return
+	}
+	l.free++
+}
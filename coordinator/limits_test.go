@@ -0,0 +1,128 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/metno/rove/proto"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimitUnaryInterceptor(t *testing.T) {
+	// one request allowed, and no more ever after
+	interceptor := rateLimitUnaryInterceptor(rate.NewLimiter(0, 1))
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return &pb.ValidateSyncResponse{}, nil
+	}
+	call := func(method string) error {
+		_, err := interceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+
+	if validateOneSyncMethod != "/coordinator.Coordinator/ValidateOneSync" {
+		t.Errorf("ValidateOneSync's method name is %s", validateOneSyncMethod)
+	}
+	if err := call(validateOneSyncMethod); err != nil {
+		t.Fatalf("first call was rejected: %v", err)
+	}
+	if err := call(validateOneSyncMethod); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("second call gave error %v, expected ResourceExhausted", err)
+	}
+
+	// RPCs that don't run tests aren't limited
+	if err := call("/" + pb.Coordinator_ServiceDesc.ServiceName + "/GetDag"); err != nil {
+		t.Errorf("GetDag was rejected: %v", err)
+	}
+}
+
+func TestTestLimiterCapsRunningTests(t *testing.T) {
+	const max_running = 3
+
+	// top depends on eight tests that can all run at once
+	config := pipelineConfig{Tests: []testConfig{{Name: "capped_top"}}}
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("capped_%d", i)
+		config.Tests[0].DependsOn = append(config.Tests[0].DependsOn, name)
+		config.Tests = append(config.Tests, testConfig{Name: name})
+	}
+	dag, info, err := buildPipeline(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	running, most_running, runs := 0, 0, 0
+	blocking := func(ctx context.Context, input testInput) (pb.Flag, error) {
+		mutex.Lock()
+		running++
+		runs++
+		if running > most_running {
+			most_running = running
+		}
+		mutex.Unlock()
+
+		// held long enough for the other tests to pile up behind it
+		time.Sleep(10 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return pb.Flag_OK, nil
+	}
+	stubs := make(map[string]testFunc)
+	for _, test := range config.Tests {
+		stubs[test.Name] = blocking
+	}
+	stubTests(t, stubs)
+
+	s := newTestServer()
+	s.pipelines[""] = pipeline{dag: dag, info: info}
+	s.testLimiter = newTestLimiter(max_running)
+
+	// several validations at once, each of which could run eight tests at
+	// once on its own
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(data_id uint32) {
+			defer wg.Done()
+			if _, err := s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: data_id, Tests: []string{"capped_top"}}); err != nil {
+				t.Errorf("validation of data %d failed: %v", data_id, err)
+			}
+		}(uint32(i + 1))
+	}
+	wg.Wait()
+
+	if runs != 4*len(config.Tests) {
+		t.Errorf("%d tests ran, expected %d", runs, 4*len(config.Tests))
+	}
+	if most_running > max_running {
+		t.Errorf("%d tests ran at once, expected at most %d", most_running, max_running)
+	}
+}
+
+func TestTestLimiterGivesUpWithContext(t *testing.T) {
+	limiter := newTestLimiter(1)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("acquire with no free slot gave error %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	// the waiter that gave up doesn't hold on to the slot once it is freed
+	limiter.release()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := limiter.acquire(ctx); err != nil {
+		t.Errorf("acquire after release gave error %v", err)
+	}
+}
@@ -0,0 +1,1289 @@
+// Package coordinator is the rove coordinator, which validates data by running
+// QC tests in the order their dependencies allow and streaming back their
+// flags. It is run as rove coordinator, or the standalone coordinator binary.
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/intarga/dagrid"
+	pb "github.com/metno/rove/proto"
+	"github.com/metno/rove/version"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+func constructDag() dagrid.Dag {
+	dag := dagrid.New_dag()
+
+	// the dag is hardcoded, so any error here is a bug
+	must := func(err error) {
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	dag.Insert_free_node("test1")
+
+	must(insertChildByName(&dag, "test1", "test2"))
+	must(insertChildByName(&dag, "test1", "test3"))
+
+	must(insertChildByName(&dag, "test2", "test4"))
+	must(insertChildByName(&dag, "test3", "test5"))
+
+	must(insertChildByName(&dag, "test4", "test6"))
+	must(addEdgeByName(&dag, "test5", "test6"))
+
+	return dag
+}
+
+// testInfo is metadata about a test, sent to clients along with its flags
+type testInfo struct {
+	description string
+	severity    pb.Severity
+	// groups the test can be requested by, as "@group"
+	groups []string
+	// when more tests are ready than allowed to run at once, ones with a
+	// higher priority are run first
+	priority int
+	// passed to the test as its input's params. never modified
+	// form: params[param_name]value
+	params map[string]float64
+	// flags that, if the test gives them, mean the tests that depend on it
+	// are skipped rather than run
+	skipDependentsOn []pb.Flag
+	// how long the test can run before it is cancelled and gives an error,
+	// 0 for no limit
+	timeout time.Duration
+}
+
+func constructTestInfo() map[string]testInfo {
+	return map[string]testInfo{
+		"test1": {description: "Placeholder test 1", severity: pb.Severity_HIGH},
+		"test2": {description: "Placeholder test 2", severity: pb.Severity_MEDIUM, groups: []string{"temperature"}},
+		"test3": {description: "Placeholder test 3", severity: pb.Severity_MEDIUM, groups: []string{"wind"}},
+		"test4": {description: "Placeholder test 4", severity: pb.Severity_LOW, groups: []string{"temperature"}},
+		"test5": {description: "Placeholder test 5", severity: pb.Severity_LOW, groups: []string{"wind"}},
+		"test6": {description: "Placeholder test 6", severity: pb.Severity_LOW},
+	}
+}
+
+func constructSubDagIter(dag *dagrid.Dag, subdag *dagrid.Dag, curr_index int, nodes_visited map[int]int) {
+	for _, child := range sortedChildren(dag, curr_index) {
+		new_index, ok := nodes_visited[child]
+
+		if !ok {
+			new_index = subdag.Insert_child(nodes_visited[curr_index], dag.Nodes[child].Contents)
+			nodes_visited[child] = new_index
+
+			constructSubDagIter(dag, subdag, child, nodes_visited)
+		} else {
+			subdag.Add_edge(nodes_visited[curr_index], new_index)
+		}
+	}
+}
+
+// constructSubDag returns the part of dag needed to run required_nodes: exactly
+// the requested tests and their descendants, the tests they depend on, with
+// the edges between them. Nothing above or beside them is included, so
+// requesting an interior test like test4 gives just test4 and test6, even
+// though test4's parent test2 has other children.
+//
+// TODO: maybe move this to package dagrid?
+func constructSubDag(dag dagrid.Dag, required_nodes []string) (dagrid.Dag, error) {
+	subdag := dagrid.New_dag()
+
+	// nodes are put into the map when visited as [dag_index]subdag_index
+	nodes_visited := make(map[int]int)
+
+	required_indices := make([]int, 0, len(required_nodes))
+	unknown := &unknownTestsError{suggestions: make(map[string][]string)}
+	for _, req := range required_nodes {
+		index, ok := dag.IndexLookup[req]
+		if !ok {
+			unknown.tests = append(unknown.tests, req)
+			unknown.suggestions[req] = suggestTests(req, dag.IndexLookup)
+			continue
+		}
+		required_indices = append(required_indices, index)
+	}
+	if len(unknown.tests) > 0 {
+		return dagrid.Dag{}, unknown
+	}
+
+	// traverse in dag order rather than the order the tests were listed in,
+	// so the subdag comes out the same however the client orders them.
+	// otherwise a test listed before one of its ancestors would be inserted
+	// as a free node and get a different index
+	sort.Ints(required_indices)
+
+	for _, index := range required_indices {
+		_, ok := nodes_visited[index]
+		if !ok {
+			new_index := subdag.Insert_free_node(dag.Nodes[index].Contents)
+			nodes_visited[index] = new_index
+
+			constructSubDagIter(&dag, &subdag, index, nodes_visited)
+		}
+	}
+
+	// a node that was inserted as a leaf may have gained children from a
+	// later Add_edge, and ValidateOne starts by running every leaf
+	dropStaleLeaves(&subdag)
+
+	// the traversal should have visited exactly the descendant closure. if it
+	// didn't, tests would silently be skipped or run when they shouldn't, so
+	// the request fails instead. this is a bug here, not in the request
+	closure := make(map[int]bool)
+	for _, index := range required_indices {
+		closure[index] = true
+		for _, descendant := range dagDescendants(&dag, index) {
+			closure[descendant] = true
+		}
+	}
+	if len(closure) != len(nodes_visited) || len(nodes_visited) != len(subdag.Nodes) {
+		return dagrid.Dag{}, status.Errorf(codes.Internal, "subdag of %v has %d tests, expected %d", required_nodes, len(subdag.Nodes), len(closure))
+	}
+	for index := range closure {
+		if _, ok := nodes_visited[index]; !ok {
+			return dagrid.Dag{}, status.Errorf(codes.Internal, "subdag of %v is missing %s", required_nodes, dag.Nodes[index].Contents)
+		}
+	}
+
+	return subdag, nil
+}
+
+// testInput is what a test is run on
+type testInput struct {
+	// the validation the test is run for, to correlate logs
+	requestId string
+	dataId    uint32
+	stationId uint32
+	latitude  float64
+	longitude float64
+	// zero unless the request covers a time range
+	time time.Time
+	// the observed values at time, if the client sent them
+	values []float64
+	// the test's parameters from the pipeline, e.g. thresholds. set per test
+	// when it is dispatched
+	// form: params[param_name]value
+	params map[string]float64
+}
+
+// testResult is the outcome of running a single test. If the test failed
+// while running, err is set and flag should be ignored. If the test was never
+// run, because it has no implementation or the pipeline skipped it, skipped
+// is set as well, and err says why. A skipped test has no flag of its own,
+// ValidateOne gives it the coordinator's --unrun-flag.
+type testResult struct {
+	name    string
+	flag    pb.Flag
+	err     error
+	skipped bool
+	// when the test started running and how long it took, unset if it was
+	// skipped
+	start    time.Time
+	duration time.Duration
+}
+
+// skipsDependents reports whether result means the tests depending on the
+// test described by info shouldn't be run
+func skipsDependents(info testInfo, result testResult) bool {
+	if result.skipped {
+		return false
+	}
+
+	given := result.flag
+	if result.err != nil {
+		given = pb.Flag_ERROR
+	}
+	for _, skip_flag := range info.skipDependentsOn {
+		if given == skip_flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runSubDag runs every test in subdag on input, each only once all its
+// children have completed. onComplete is called from the calling goroutine
+// with the result of each test as it finishes. A test that errors still
+// counts as completed, so its parents are run regardless. runSubDag returns
+// once all the tests are done, or early with ctx's error if it is cancelled,
+// or with onComplete's error if it returns one. Either way, tests still
+// running are cancelled, and runSubDag waits for their goroutines to exit
+// before returning, so none outlive the validation.
+//
+// If max_tests limits how many tests can run at once, ready tests are run in
+// order of priority, then the length of the path above them in the dag. 0 is
+// no limit.
+func (s *server) runSubDag(ctx context.Context, subdag *dagrid.Dag, info map[string]testInfo, input testInput, max_tests int, onComplete func(result testResult) error) error {
+	// All the scheduling state below (nodes_left, children_completed_map,
+	// ready, running, scheduled, completed, blocked) is confined to this
+	// goroutine. Tests run on their own goroutines, but only ever get their
+	// name and input, and hand their results back over ch, so none of this
+	// needs locking. Keep it that way: anything else that needs to act on a
+	// result should do it in onComplete, which also runs here.
+
+	// deferred in this order so tests are cancelled before they are waited
+	// for. otherwise returning early because onComplete failed would wait
+	// for every running test to finish
+	var tests sync.WaitGroup
+	defer tests.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	nodes_left := len(subdag.Nodes) // warning: this assumes no nodes were removed from the dag
+
+	// how many children of each node have been run
+	// form: children_completed_map[node_index]children_completed
+	children_completed_map := make(map[int]int)
+
+	// buffered so tests finishing after the validation is cancelled don't
+	// block forever
+	ch := make(chan testResult, len(subdag.Nodes))
+
+	distances := rootDistances(subdag)
+
+	// nodes that are ready to run but haven't been dispatched yet
+	var ready []int
+	running := 0
+
+	// every node is run exactly once, even if the completion accounting for a
+	// diamond would otherwise make it ready twice
+	// form: scheduled[node_index]
+	scheduled := make(map[int]bool)
+	schedule := func(index int) {
+		if scheduled[index] {
+			return
+		}
+		scheduled[index] = true
+		ready = append(ready, index)
+	}
+
+	// nodes whose result has been handled. a second result for one of these,
+	// e.g. from a test that finished late after being given up on, must not
+	// count towards its parents again, or a parent could be scheduled before
+	// all its children have run
+	// form: completed[node_index]
+	completed := make(map[int]bool)
+
+	// nodes that won't be run, because a test they depend on gave a flag that
+	// its skipDependentsOn says they shouldn't run after, with why
+	// form: blocked[node_index]reason
+	blocked := make(map[int]string)
+
+	dispatch := func() {
+		sort.SliceStable(ready, func(i, j int) bool {
+			priority_i := info[subdag.Nodes[ready[i]].Contents].priority
+			priority_j := info[subdag.Nodes[ready[j]].Contents].priority
+			if priority_i != priority_j {
+				return priority_i > priority_j
+			}
+			return distances[ready[i]] > distances[ready[j]]
+		})
+
+		for len(ready) > 0 && (max_tests == 0 || running < max_tests) {
+			index := ready[0]
+			ready = ready[1:]
+			running++
+
+			name := subdag.Nodes[index].Contents
+			if reason, ok := blocked[index]; ok {
+				// goes through ch like any other result, so it's accounted
+				// for the same way. ch has room for a result from every node
+				ch <- testResult{name: name, err: errors.New(reason), skipped: true}
+				continue
+			}
+
+			test_input := input
+			test_input.params = info[name].params
+
+			log.Printf("dispatching %s for request %s", name, input.requestId)
+			tests.Add(1)
+			go func() {
+				defer tests.Done()
+
+				// nothing is sent if ctx ends while waiting, as with a
+				// test cancelled while running
+				release, err := s.acquireTestSlot(ctx)
+				if err != nil {
+					return
+				}
+				defer release()
+
+				runTestFunc(ctx, name, test_input, info[name].timeout, ch)
+			}()
+		}
+	}
+
+	for _, leaf_index := range sortedLeaves(subdag) {
+		schedule(leaf_index)
+	}
+	dispatch()
+
+	for {
+		var result testResult
+		select {
+		case result = <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		completed_index, ok := subdag.IndexLookup[result.name]
+		if !ok || !scheduled[completed_index] || completed[completed_index] {
+			log.Printf("ignoring unexpected result of %s for request %s", result.name, input.requestId)
+			continue
+		}
+		completed[completed_index] = true
+
+		nodes_left--
+		running--
+
+		if err := onComplete(result); err != nil {
+			return err
+		}
+
+		if nodes_left == 0 {
+			return nil
+		}
+
+		// a skipped test's dependents are skipped too, since they depend on
+		// it indirectly
+		reason, skip_parents := blocked[completed_index]
+		if !skip_parents && skipsDependents(info[result.name], result) {
+			reason = fmt.Sprintf("not run, because %s gave %s", result.name, result.flag)
+			skip_parents = true
+		}
+
+		for _, parent_index := range sortedParents(subdag, completed_index) {
+			if _, ok := blocked[parent_index]; skip_parents && !ok {
+				blocked[parent_index] = reason
+			}
+
+			// TODO: think the contents of this loop can be simplified
+			children_completed, ok := children_completed_map[parent_index]
+			if !ok { // FIXME: is this necessary? default value of int should be 0 anyway
+				children_completed = 0
+			}
+
+			children_completed++
+			children_completed_map[parent_index] = children_completed
+
+			if children_completed >= len(subdag.Nodes[parent_index].Children) {
+				schedule(parent_index)
+			}
+		}
+
+		dispatch()
+	}
+}
+
+type server struct {
+	pb.UnimplementedCoordinatorServer
+	// guards pipelines, which is replaced whole when pipelines are
+	// reloaded. use currentPipeline rather than reading it directly
+	pipelineMutex sync.RWMutex
+	// the pipelines requests can choose from. the default pipeline, used by
+	// requests that don't choose one, is named ""
+	// form: pipelines[pipeline_name]pipeline
+	pipelines map[string]pipeline
+	sinks     []ResultSink
+	active    *validationRegistry
+	// nil if there is no limit on concurrent validations
+	limiter *validationLimiter
+	cache   *resultCache
+	// how often to send heartbeats on validation streams, 0 for never
+	heartbeat time.Duration
+	// how many responses can be queued for a slow client before the
+	// validation waits for it
+	sendBuffer int
+	// nil if validations aren't audited
+	audit *auditLog
+	// nil if no overall verdict is sent
+	verdict verdictPolicy
+	// most tests a validation can run at once, 0 for no limit. requests can
+	// lower it for themselves, but not raise it
+	maxTests int
+	// nil if there is no limit on tests running at once across all
+	// validations
+	testLimiter *testLimiter
+	// the flag given to tests that weren't run, whether because they have no
+	// implementation or because the pipeline skipped them
+	unrunFlag pb.Flag
+	// nil if observations aren't fetched for requests without values
+	data DataSource
+	// nil if there is no results db to read stored flags from
+	store *postgresSink
+	// whether to log extra detail, like the subdag each validation runs
+	debug bool
+}
+
+// validateRequest rejects malformed requests before any work is done.
+// An empty test list is an error rather than shorthand for "all tests", so a
+// client that forgot to fill it in gets told instead of running the whole dag.
+func validateRequest(in *pb.ValidateOneRequest) error {
+	if in.DataId == 0 {
+		return status.Error(codes.InvalidArgument, "no data id given")
+	}
+	if len(in.Tests) == 0 {
+		return status.Error(codes.InvalidArgument, "no tests requested")
+	}
+
+	seen := make(map[string]bool)
+	for i, test := range in.Tests {
+		if test == "" {
+			return status.Errorf(codes.InvalidArgument, "empty test name at position %d", i)
+		}
+		if seen[test] {
+			return status.Errorf(codes.InvalidArgument, "test %q requested more than once", test)
+		}
+		seen[test] = true
+	}
+
+	if in.Timeout != nil && in.Timeout.AsDuration() <= 0 {
+		return status.Error(codes.InvalidArgument, "timeout must be positive")
+	}
+
+	return nil
+}
+
+// startValidation holds back a validation until --max-concurrent-validations
+// allows it to run, then registers it so it can be listed and cancelled. Every
+// kind of validation goes through this. done undoes both, and must be called
+// once the validation is finished if startValidation succeeded.
+func (s *server) startValidation(ctx context.Context, validation *activeValidation) (done func(), err error) {
+	if s.limiter != nil {
+		if err := s.limiter.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if !s.active.add(validation) {
+		if s.limiter != nil {
+			s.limiter.release()
+		}
+		return nil, status.Errorf(codes.AlreadyExists, "a validation with request id %q is already running", validation.requestId)
+	}
+
+	return func() {
+		s.active.remove(validation.requestId)
+		if s.limiter != nil {
+			s.limiter.release()
+		}
+	}, nil
+}
+
+// acquireTestSlot blocks until --max-concurrent-tests-total allows another
+// test to run, or returns ctx's error if it ends first. release must be called
+// once the test is done if acquireTestSlot succeeded.
+func (s *server) acquireTestSlot(ctx context.Context) (release func(), err error) {
+	if s.testLimiter == nil {
+		return func() {}, nil
+	}
+
+	if err := s.testLimiter.acquire(ctx); err != nil {
+		return nil, err
+	}
+	return s.testLimiter.release, nil
+}
+
+func (s *server) ValidateOne(in *pb.ValidateOneRequest, srv pb.Coordinator_ValidateOneServer) (err error) {
+	audit := auditEntry{
+		RequestId: in.RequestId,
+		DataId:    in.DataId,
+		Tests:     in.Tests,
+		Start:     time.Now(),
+		Flags:     make(map[string]int),
+	}
+	if s.audit != nil {
+		defer func() {
+			audit.End = time.Now()
+			s.audit.write(audit, err)
+		}()
+	}
+
+	if err := validateRequest(in); err != nil {
+		return err
+	}
+
+	request_id := in.RequestId
+	if request_id == "" {
+		request_id = incomingRequestId(srv.Context())
+	}
+	if request_id == "" {
+		request_id = newRequestId()
+	}
+	audit.RequestId = request_id
+
+	// tell the client the id even if it didn't pick it, so it can be used to
+	// find the validation in the logs. this has to happen before anything is
+	// sent
+	if err := srv.SetHeader(metadata.Pairs(requestIdHeader, request_id)); err != nil {
+		log.Printf("failed to send request id header for request %s: %v", request_id, err)
+	}
+
+	times, err := requestTimes(in)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	fingerprint, err := requestFingerprint(in)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if in.IdempotencyKey != "" {
+		responses, ok, mismatch := s.cache.get(in.IdempotencyKey, fingerprint)
+		if mismatch {
+			return status.Errorf(codes.InvalidArgument, "idempotency key %q was already used for a different request", in.IdempotencyKey)
+		}
+		if ok {
+			for _, resp := range responses {
+				if err := srv.Send(resp); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	sender := newQueuedSender(srv, s.sendBuffer)
+	defer sender.Close()
+
+	// stopped early, before the last responses are sent, so no heartbeat can
+	// follow them. stopping twice is fine
+	stop_heartbeats := func() {}
+	if s.heartbeat > 0 {
+		stop_heartbeats = startHeartbeats(srv.Context(), s.heartbeat, sender)
+		defer stop_heartbeats()
+	}
+
+	// the whole validation runs against the pipeline as it is now, even if
+	// it is reloaded before the validation finishes
+	dag, info, err := s.currentPipeline(in.Pipeline)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	tests, err := expandGroups(info, in.Tests)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	subdag, err := constructSubDag(dag, tests)
+	if err != nil {
+		return invalidArgument(err)
+	}
+
+	// the tests below the changed ones aren't run again, their last stored
+	// flags are sent in their place. a test with no stored flag is run as if
+	// it had changed
+	var replay []storedFlag
+	if len(in.ChangedTests) > 0 {
+		if s.store == nil {
+			return status.Error(codes.FailedPrecondition, "changed_tests needs a results db to take the unchanged tests' flags from")
+		}
+		// which tests are rerun is worked out once for the whole validation,
+		// but each step of a time range can have different stored flags
+		if len(times) > 1 {
+			return status.Error(codes.InvalidArgument, "changed_tests can't be used with a time range")
+		}
+
+		rows, err := s.store.flags(srv.Context(), in.DataId)
+		if err != nil {
+			log.Printf("failed to read flags for data %d: %v", in.DataId, err)
+			return status.Errorf(codes.Internal, "failed to read flags for data %d", in.DataId)
+		}
+		last := lastFlags(rows, in.Pipeline, in.StationId, times[0])
+
+		var names []string
+		changed := append([]string{}, in.ChangedTests...)
+		for _, node := range subdag.Nodes {
+			names = append(names, node.Contents)
+			if _, ok := last[node.Contents]; !ok {
+				changed = append(changed, node.Contents)
+			}
+		}
+
+		if err := keepChanged(&subdag, changed); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		for _, name := range names {
+			if _, ok := subdag.IndexLookup[name]; !ok {
+				replay = append(replay, last[name])
+			}
+		}
+	}
+	if s.debug {
+		log.Printf("subdag for request %s: %s", request_id, dagString(&subdag))
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if in.Timeout != nil {
+		ctx, cancel = context.WithTimeout(srv.Context(), in.Timeout.AsDuration())
+	} else {
+		ctx, cancel = context.WithCancel(srv.Context())
+	}
+	defer cancel()
+
+	total := len(subdag.Nodes)*len(times) + len(replay)
+	completed := 0
+
+	max_tests := s.maxTests
+	if limit := int(in.MaxConcurrentTests); limit > 0 && (max_tests == 0 || limit < max_tests) {
+		max_tests = limit
+	}
+
+	validation := &activeValidation{
+		requestId: request_id,
+		cancel:    cancel,
+		dataId:    in.DataId,
+		tests:     in.Tests,
+		start:     audit.Start,
+		total:     total,
+	}
+	done, err := s.startValidation(srv.Context(), validation)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	// kept for the verdict, and to be cached if the request has an
+	// idempotency key
+	var sent []*pb.ValidateResponse
+
+	// fail fast validations hold their flags back until every test has
+	// passed, so the client gets either all of them or just an error
+	type heldFlag struct {
+		test string
+		resp *pb.ValidateResponse
+	}
+	var held []heldFlag
+
+	deliver := func(test_name string, resp *pb.ValidateResponse) error {
+		if err := sender.Send(resp); err != nil {
+			return err
+		}
+		s.record(request_id, in.Pipeline, test_name, resp)
+		sent = append(sent, resp)
+
+		return nil
+	}
+
+	// finish counts a test's flag towards the validation, then sends it or
+	// holds it back
+	finish := func(test_name string, resp *pb.ValidateResponse) error {
+		s.active.progress(request_id, completed)
+		audit.Flags[resp.Flag.String()]++
+
+		if in.FailFast {
+			if failed(resp.Flag) {
+				return status.Errorf(codes.Aborted, "validation %s aborted: test %s gave %s", request_id, test_name, resp.Flag)
+			}
+			held = append(held, heldFlag{test: test_name, resp: resp})
+			return nil
+		}
+
+		return deliver(test_name, resp)
+	}
+
+	for _, row := range replay {
+		completed++
+
+		test_info := info[row.test]
+		resp := &pb.ValidateResponse{
+			DataId:      in.DataId,
+			StationId:   in.StationId,
+			FlagId:      uint32(dag.IndexLookup[row.test]),
+			Flag:        row.flag,
+			Description: test_info.description,
+			Severity:    test_info.severity,
+			Completed:   uint32(completed),
+			Total:       uint32(total),
+		}
+		if !times[0].IsZero() {
+			resp.Time = timestamppb.New(times[0])
+		}
+
+		if err := finish(row.test, resp); err != nil {
+			return err
+		}
+	}
+
+	for i, t := range times {
+		input := testInput{
+			requestId: request_id,
+			dataId:    in.DataId,
+			stationId: in.StationId,
+			latitude:  in.Latitude,
+			longitude: in.Longitude,
+			time:      t,
+			values:    in.Values,
+		}
+		if len(times) > 1 && len(in.Values) > 0 {
+			input.values = in.Values[i : i+1]
+		}
+		if len(in.Values) == 0 && s.data != nil {
+			values, err := s.data.Fetch(ctx, in.DataId, in.StationId, t)
+			if err != nil {
+				return status.Errorf(codes.Unavailable, "failed to fetch observation for data %d: %v", in.DataId, err)
+			}
+			input.values = values
+		}
+
+		err := s.runSubDag(ctx, &subdag, info, input, max_tests, func(result testResult) error {
+			completed++
+
+			test_info := info[result.name]
+			resp := &pb.ValidateResponse{
+				DataId:      in.DataId,
+				StationId:   in.StationId,
+				FlagId:      uint32(dag.IndexLookup[result.name]),
+				Flag:        result.flag,
+				Description: test_info.description,
+				Severity:    test_info.severity,
+				Completed:   uint32(completed),
+				Total:       uint32(total),
+			}
+			if result.skipped {
+				resp.Flag = s.unrunFlag
+				resp.ErrorMessage = result.err.Error()
+			} else if result.err != nil {
+				log.Printf("test %s failed for request %s: %v", result.name, request_id, result.err)
+				resp.Flag = pb.Flag_ERROR
+				resp.ErrorMessage = result.err.Error()
+			}
+			if !t.IsZero() {
+				resp.Time = timestamppb.New(t)
+			}
+			if !result.start.IsZero() {
+				resp.StartedAt = timestamppb.New(result.start)
+				resp.Duration = durationpb.New(result.duration)
+			}
+
+			return finish(result.name, resp)
+		})
+		// flags sent before this are kept, so the client still gets partial
+		// results
+		if err == context.DeadlineExceeded {
+			return status.Errorf(codes.DeadlineExceeded, "validation %s ran out of time", request_id)
+		}
+		if err == context.Canceled {
+			return status.Errorf(codes.Canceled, "validation %s cancelled", request_id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, held_flag := range held {
+		if err := deliver(held_flag.test, held_flag.resp); err != nil {
+			return err
+		}
+	}
+
+	stop_heartbeats()
+
+	if s.verdict != nil {
+		resp := &pb.ValidateResponse{
+			DataId:    in.DataId,
+			Flag:      s.verdict(sent),
+			Completed: uint32(total),
+			Total:     uint32(total),
+			Verdict:   true,
+		}
+		if err := sender.Send(resp); err != nil {
+			return err
+		}
+		sent = append(sent, resp)
+	}
+
+	complete := &pb.ValidateResponse{
+		DataId:    in.DataId,
+		Completed: uint32(total),
+		Total:     uint32(total),
+		Complete:  true,
+	}
+	if err := sender.Send(complete); err != nil {
+		return err
+	}
+	sent = append(sent, complete)
+
+	// only done once everything has actually reached the client
+	if err := sender.Close(); err != nil {
+		return err
+	}
+
+	if in.IdempotencyKey != "" {
+		s.cache.put(in.IdempotencyKey, fingerprint, sent)
+	}
+
+	return nil
+}
+
+func (s *server) CancelValidation(ctx context.Context, in *pb.CancelValidationRequest) (*pb.CancelValidationResponse, error) {
+	if !s.active.cancel(in.RequestId) {
+		return nil, status.Errorf(codes.NotFound, "no validation with request id %q is running", in.RequestId)
+	}
+
+	return &pb.CancelValidationResponse{}, nil
+}
+
+func (s *server) PlanValidation(ctx context.Context, in *pb.PlanValidationRequest) (*pb.PlanValidationResponse, error) {
+	if len(in.Tests) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no tests requested")
+	}
+
+	dag, info, err := s.currentPipeline(in.Pipeline)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	tests, err := expandGroups(info, in.Tests)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	subdag, err := constructSubDag(dag, tests)
+	if err != nil {
+		return nil, invalidArgument(err)
+	}
+
+	resp := &pb.PlanValidationResponse{}
+	for _, level := range dagLevels(&subdag) {
+		resp.Levels = append(resp.Levels, &pb.PlanLevel{Tests: level})
+	}
+
+	return resp, nil
+}
+
+func (s *server) ListValidations(ctx context.Context, in *pb.ListValidationsRequest) (*pb.ListValidationsResponse, error) {
+	resp := &pb.ListValidationsResponse{}
+	for _, validation := range s.active.list() {
+		resp.Validations = append(resp.Validations, &pb.ActiveValidation{
+			RequestId: validation.requestId,
+			DataId:    validation.dataId,
+			Tests:     validation.tests,
+			StartTime: timestamppb.New(validation.start),
+			Completed: uint32(validation.completed),
+			Total:     uint32(validation.total),
+		})
+	}
+
+	return resp, nil
+}
+
+func (s *server) ListTests(ctx context.Context, in *pb.ListTestsRequest) (*pb.ListTestsResponse, error) {
+	dag, info, err := s.currentPipeline(in.Pipeline)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	names := make([]string, 0, len(dag.IndexLookup))
+	for name := range dag.IndexLookup {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	resp := &pb.ListTestsResponse{}
+	for _, name := range names {
+		var depends_on []string
+		for _, child := range sortedChildren(&dag, dag.IndexLookup[name]) {
+			depends_on = append(depends_on, dag.Nodes[child].Contents)
+		}
+		sort.Strings(depends_on)
+
+		resp.Tests = append(resp.Tests, &pb.TestDescription{
+			Name:        name,
+			Description: info[name].description,
+			Severity:    info[name].severity,
+			Groups:      info[name].groups,
+			DependsOn:   depends_on,
+			Parameters:  info[name].params,
+		})
+	}
+
+	return resp, nil
+}
+
+func (s *server) GetDag(ctx context.Context, in *pb.GetDagRequest) (*pb.GetDagResponse, error) {
+	dag, info, err := s.currentPipeline(in.Pipeline)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if len(in.Tests) > 0 {
+		tests, err := expandGroups(info, in.Tests)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		dag, err = constructSubDag(dag, tests)
+		if err != nil {
+			return nil, invalidArgument(err)
+		}
+	}
+
+	resp := &pb.GetDagResponse{}
+	for name := range dag.IndexLookup {
+		resp.Nodes = append(resp.Nodes, name)
+	}
+	sort.Strings(resp.Nodes)
+
+	var edges [][2]string
+	for edge := range dagEdges(&dag) {
+		edges = append(edges, edge)
+	}
+	sortEdges(edges)
+	for _, edge := range edges {
+		resp.Edges = append(resp.Edges, &pb.DagEdge{Parent: edge[0], Child: edge[1]})
+	}
+
+	for _, leaf := range sortedLeaves(&dag) {
+		resp.Leaves = append(resp.Leaves, dag.Nodes[leaf].Contents)
+	}
+	sort.Strings(resp.Leaves)
+
+	return resp, nil
+}
+
+func (s *server) GetFlags(ctx context.Context, in *pb.GetFlagsRequest) (*pb.GetFlagsResponse, error) {
+	if s.store == nil {
+		return nil, status.Error(codes.FailedPrecondition, "no results db is configured")
+	}
+
+	flags, err := s.store.flags(ctx, in.DataId)
+	if err != nil {
+		log.Printf("failed to read flags for data %d: %v", in.DataId, err)
+		return nil, status.Errorf(codes.Internal, "failed to read flags for data %d", in.DataId)
+	}
+
+	resp := &pb.GetFlagsResponse{}
+	for _, row := range flags {
+		stored := &pb.StoredFlag{
+			RequestId: row.requestId,
+			StationId: row.stationId,
+			Pipeline:  row.pipeline,
+			Test:      row.test,
+			FlagId:    row.flagId,
+			Flag:      row.flag,
+			Time:      timestamppb.New(row.time),
+		}
+		if !row.obsTime.IsZero() {
+			stored.ObsTime = timestamppb.New(row.obsTime)
+		}
+		resp.Flags = append(resp.Flags, stored)
+	}
+
+	return resp, nil
+}
+
+// defaultPort is the port to listen on if --port isn't given, taken from
+// ROVE_PORT if that is set
+func defaultPort() int {
+	env, ok := os.LookupEnv("ROVE_PORT")
+	if !ok {
+		return 50051
+	}
+
+	port, err := strconv.Atoi(env)
+	if err != nil {
+		log.Fatalf("invalid ROVE_PORT %q: %v", env, err)
+	}
+
+	return port
+}
+
+// Main runs a coordinator configured by the command line flags in args, which
+// don't include the program name. It returns once the coordinator has shut
+// down, and exits the process if it can't start.
+func Main(args []string) {
+	flags := flag.NewFlagSet("coordinator", flag.ExitOnError)
+	show_version := flags.Bool("version", false, "print build information and exit")
+	port := flags.Int("port", defaultPort(), "port to listen on, defaults to ROVE_PORT if set")
+	pipeline_file := flags.String("pipeline", "", "JSON file defining the tests to run and how they depend on each other. the built in placeholder pipeline is used if empty")
+	named_pipelines := flags.String("named-pipelines", "", "comma separated name=file pairs of more pipelines, in the same format as --pipeline, which requests can choose by name")
+	results_db := flags.String("results-db", "", "postgres connection string to store results in, results aren't stored if empty")
+	results_table := flags.String("results-table", "flags", "table in the results db to store results in")
+	kafka_brokers := flags.String("kafka-brokers", "", "comma separated kafka brokers to publish results to, results aren't published if empty")
+	kafka_topic := flags.String("kafka-topic", "qc-flags", "kafka topic to publish results to")
+	kafka_encoding := flags.String("kafka-encoding", "proto", "encoding of results published to kafka, proto or json")
+	max_rps := flags.Float64("max-rps", 0, "maximum validation requests accepted per second, 0 for no limit")
+	max_concurrent := flags.Int("max-concurrent-validations", 0, "maximum validations running at once, 0 for no limit")
+	max_queued := flags.Int("max-queued-validations", 0, "maximum validations waiting for one of --max-concurrent-validations to finish, beyond which they are rejected")
+	idempotency_ttl := flags.Duration("idempotency-ttl", 10*time.Minute, "how long results are kept for replaying requests with an idempotency key")
+	keepalive_time := flags.Duration("keepalive-time", 30*time.Second, "how long a connection can be idle before it is pinged to check it is still alive")
+	send_buffer := flags.Int("send-buffer", 64, "responses queued per validation for a slow client before the validation waits for it to catch up")
+	heartbeat_interval := flags.Duration("heartbeat-interval", 0, "how often to send heartbeat responses on validation streams, 0 to not send them")
+	audit_log := flags.String("audit-log", "", "file to append a JSON line to for every validation, validations aren't audited if empty")
+	max_tests := flags.Int("max-concurrent-tests", 0, "maximum tests a single validation runs at once, 0 for no limit")
+	max_total_tests := flags.Int("max-concurrent-tests-total", 0, "maximum tests running at once across all validations, 0 for no limit. tests over it wait their turn")
+	unrun_flag := flags.String("unrun-flag", "SKIPPED", "flag given to tests that weren't run, because the pipeline skipped them or they have no implementation")
+	data_source := flags.String("data-source", "", "where to fetch observations for requests without values, frost or memory. observations aren't fetched if empty")
+	data_file := flags.String("data-file", "", "CSV fixture of data_id,time,value[,station_id] rows for --data-source=memory")
+	frost_client_id := flags.String("frost-client-id", "", "client id for the frost API, required for --data-source=frost")
+	frost_url := flags.String("frost-url", "https://frost.met.no", "base url of the frost API")
+	frost_element := flags.String("frost-element", "air_temperature", "element to fetch from the frost API")
+	placeholder_seed := flags.Int64("placeholder-seed", 0, "seed for the placeholder tests' run times, so runs can be reproduced. random if 0")
+	verdict_fail_weight := flags.Int("verdict-fail-weight", 8, "severity weight at which the weighted verdict policy fails data. failures weigh 8 for HIGH, 4 for MEDIUM and 2 for LOW severity tests, warnings half that")
+	verdict_policy := flags.String("verdict-policy", "", "how to reduce a validation's flags to an overall verdict sent at the end of the stream, one of worst-of, any-fail or weighted. no verdict is sent if empty")
+	shutdown_timeout := flags.Duration("shutdown-timeout", 30*time.Second, "how long to wait for running validations to finish on shutdown before cutting them off, 0 to wait forever")
+	log_level := flags.String("log-level", "info", "how much to log, info or debug. debug also logs the subdag each validation runs")
+	dump_dag := flags.Bool("dump-dag", false, "print the default pipeline as a Graphviz DOT graph and exit")
+	diff_pipeline := flags.String("diff-pipeline", "", "print the tests and dependencies that would change if the default pipeline were replaced by the one in this file, and exit")
+	enable_reflection := flags.Bool("enable-reflection", false, "register the grpc reflection service, for debugging with tools like grpcurl")
+	metrics_address := flags.String("metrics-address", "", "address to serve metrics on as JSON at /debug/vars, like :9090. metrics aren't served if empty")
+	flags.Parse(args)
+
+	if *show_version {
+		fmt.Printf("rove coordinator %s\n", version.String())
+		return
+	}
+	log.Printf("rove coordinator %s", version.String())
+
+	pipeline_files, err := parsePipelineFiles(*named_pipelines)
+	if err != nil {
+		log.Fatalf("invalid --named-pipelines: %v", err)
+	}
+	if *pipeline_file != "" {
+		pipeline_files[""] = *pipeline_file
+	}
+	pipelines, err := loadPipelines(pipeline_files)
+	if err != nil {
+		log.Fatalf("failed to load pipeline: %v", err)
+	}
+	if _, ok := pipelines[""]; !ok {
+		dag := constructDag()
+		if err := checkPipeline(&dag); err != nil {
+			log.Fatalf("invalid pipeline: %v", err)
+		}
+		pipelines[""] = pipeline{dag: dag, info: constructTestInfo()}
+	}
+	for name, p := range pipelines {
+		if name == "" {
+			name = "default"
+		}
+		log.Printf("pipeline %s: DAG depth=%d width=%d", name, dagDepth(&p.dag), dagMaxWidth(&p.dag))
+	}
+	publishPipelineMetrics(pipelines)
+	if *dump_dag {
+		p := pipelines[""]
+		fmt.Print(dagDot(&p.dag))
+		return
+	}
+	if *diff_pipeline != "" {
+		dag, _, err := loadPipeline(*diff_pipeline)
+		if err != nil {
+			log.Fatalf("failed to load pipeline to diff: %v", err)
+		}
+		p := pipelines[""]
+		fmt.Print(dagDiffString(&p.dag, &dag))
+		return
+	}
+
+	var sinks []ResultSink
+	var store *postgresSink
+	if *results_db != "" {
+		sink, err := newPostgresSink(*results_db, *results_table)
+		if err != nil {
+			log.Fatalf("failed to set up results db: %v", err)
+		}
+		sinks = append(sinks, sink)
+		store = sink
+	}
+	if *kafka_brokers != "" {
+		sink, err := newKafkaSink(strings.Split(*kafka_brokers, ","), *kafka_topic, *kafka_encoding)
+		if err != nil {
+			log.Fatalf("failed to set up kafka: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if *placeholder_seed != 0 {
+		placeholderSeed = *placeholder_seed
+	}
+
+	var audit *auditLog
+	if *audit_log != "" {
+		var err error
+		audit, err = openAuditLog(*audit_log)
+		if err != nil {
+			log.Fatalf("failed to open audit log: %v", err)
+		}
+	}
+
+	if *metrics_address != "" {
+		serveMetrics(*metrics_address)
+	}
+
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	// handlers are tracked so shutdown can wait for them, and recovery goes
+	// next, so it also catches panics in the other interceptors
+	handlers := &handlerTracker{}
+	stream_interceptors := []grpc.StreamServerInterceptor{handlers.streamInterceptor, recoveryStreamInterceptor}
+	unary_interceptors := []grpc.UnaryServerInterceptor{handlers.unaryInterceptor, recoveryUnaryInterceptor}
+	if *max_rps > 0 {
+		limiter := rate.NewLimiter(rate.Limit(*max_rps), int(math.Ceil(*max_rps)))
+		stream_interceptors = append(stream_interceptors, rateLimitInterceptor(limiter))
+		unary_interceptors = append(unary_interceptors, rateLimitUnaryInterceptor(limiter))
+	}
+
+	s := grpc.NewServer(
+		grpc.ChainStreamInterceptor(stream_interceptors...),
+		grpc.ChainUnaryInterceptor(unary_interceptors...),
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: *keepalive_time, Timeout: 20 * time.Second}),
+		// clients are expected to ping as well, to keep the connection alive
+		// through proxies with idle timeouts
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second, PermitWithoutStream: true}),
+	)
+	coordinator := &server{
+		pipelines:  pipelines,
+		sinks:      sinks,
+		active:     newValidationRegistry(),
+		cache:      newResultCache(*idempotency_ttl),
+		heartbeat:  *heartbeat_interval,
+		sendBuffer: *send_buffer,
+		audit:      audit,
+		maxTests:   *max_tests,
+		store:      store,
+	}
+	if unrun, ok := pb.Flag_value[*unrun_flag]; ok && unrun != int32(pb.Flag_UNSPECIFIED) {
+		coordinator.unrunFlag = pb.Flag(unrun)
+	} else {
+		log.Fatalf("invalid --unrun-flag %q", *unrun_flag)
+	}
+	switch *log_level {
+	case "info":
+	case "debug":
+		coordinator.debug = true
+	default:
+		log.Fatalf("unknown log level %q, expected info or debug", *log_level)
+	}
+	switch *data_source {
+	case "":
+	case "frost":
+		if *frost_client_id == "" {
+			log.Fatalf("--data-source=frost needs --frost-client-id")
+		}
+		coordinator.data = newFrostSource(*frost_url, *frost_client_id, *frost_element)
+	case "memory":
+		source, err := loadMemorySource(*data_file)
+		if err != nil {
+			log.Fatalf("failed to load data fixture: %v", err)
+		}
+		coordinator.data = source
+	default:
+		log.Fatalf("unknown data source %q, expected frost or memory", *data_source)
+	}
+	if *verdict_policy != "" {
+		coordinator.verdict, err = newVerdictPolicy(*verdict_policy, *verdict_fail_weight)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	if *max_total_tests > 0 {
+		coordinator.testLimiter = newTestLimiter(*max_total_tests)
+	}
+	if *max_concurrent > 0 {
+		coordinator.limiter = newValidationLimiter(*max_concurrent, *max_queued)
+	}
+	pb.RegisterCoordinatorServer(s, coordinator)
+	if *enable_reflection {
+		reflection.Register(s)
+	}
+
+	// reload the pipelines on SIGHUP. validations already running keep the
+	// pipeline they started with. the handlers are registered before serving
+	// starts, since a signal that arrives before then would otherwise get
+	// its default action and kill the coordinator
+	reload_sig := make(chan os.Signal, 1)
+	signal.Notify(reload_sig, syscall.SIGHUP)
+	go func() {
+		for range reload_sig {
+			if len(pipeline_files) == 0 {
+				log.Printf("not reloading pipelines, there are no pipeline files")
+				continue
+			}
+			if err := coordinator.reloadPipelines(pipeline_files); err != nil {
+				log.Printf("failed to reload pipelines, keeping the old ones: %v", err)
+				continue
+			}
+			log.Printf("reloaded %d pipelines", len(pipeline_files))
+		}
+	}()
+
+	// stop cleanly on interrupt, so queued results get flushed to the sinks
+	stop_sig := make(chan os.Signal, 1)
+	signal.Notify(stop_sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop_sig
+		log.Printf("shutting down")
+
+		stopped := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(stopped)
+		}()
+		if *shutdown_timeout <= 0 {
+			return
+		}
+
+		// a stuck validation would otherwise keep GracefulStop, and so the
+		// process, waiting forever
+		select {
+		case <-stopped:
+		case <-time.After(*shutdown_timeout):
+			for _, validation := range coordinator.active.list() {
+				log.Printf("cutting off validation %s, still running after %v", validation.requestId, *shutdown_timeout)
+			}
+			s.Stop()
+		}
+	}()
+
+	log.Printf("server listening at %v", lis.Addr())
+	if err := s.Serve(lis); err != nil {
+		log.Fatalf("failed to serve: %v", err)
+	}
+
+	// Serve returns as soon as Stop is called, while the handlers it cut off
+	// may still be writing results
+	handlers.wait()
+
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("failed to close result sink: %v", err)
+		}
+	}
+	if audit != nil {
+		if err := audit.Close(); err != nil {
+			log.Printf("failed to close audit log: %v", err)
+		}
+	}
+}
@@ -0,0 +1,575 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"github.com/intarga/dagrid"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server with the placeholder pipeline, and none of
+// the optional limits, sinks or stores configured
+func newTestServer() *server {
+	return &server{
+		pipelines: map[string]pipeline{"": {dag: constructDag(), info: constructTestInfo()}},
+		active:    newValidationRegistry(),
+		cache:     newResultCache(time.Minute),
+		unrunFlag: pb.Flag_SKIPPED,
+	}
+}
+
+// stubTests replaces the implementations of the named tests for the rest of
+// the test, putting back whatever was there before once it is done
+func stubTests(t *testing.T, stubs map[string]testFunc) {
+	t.Helper()
+
+	// form: previous[test_name]implementation
+	previous := make(map[string]testFunc)
+	for name, fn := range stubs {
+		if old, ok := testFuncs[name]; ok {
+			previous[name] = old
+		}
+		testFuncs[name] = fn
+	}
+
+	t.Cleanup(func() {
+		for name := range stubs {
+			if old, ok := previous[name]; ok {
+				testFuncs[name] = old
+			} else {
+				delete(testFuncs, name)
+			}
+		}
+	})
+}
+
+// collectingSink keeps every result written to it
+type collectingSink struct {
+	results []Result
+}
+
+func (sink *collectingSink) Write(res Result) {
+	sink.results = append(sink.results, res)
+}
+
+func (sink *collectingSink) Close() error {
+	return nil
+}
+
+// recordingStream is a server stream for the streaming validations that keeps
+// everything sent on it
+type recordingStream struct {
+	grpc.ServerStream
+	sent []*pb.ValidateResponse
+}
+
+func (stream *recordingStream) Context() context.Context {
+	return context.Background()
+}
+
+func (stream *recordingStream) SetHeader(metadata.MD) error {
+	return nil
+}
+
+func (stream *recordingStream) Send(resp *pb.ValidateResponse) error {
+	stream.sent = append(stream.sent, resp)
+	return nil
+}
+
+// passingTest is a test implementation that passes straight away
+func passingTest(ctx context.Context, input testInput) (pb.Flag, error) {
+	return pb.Flag_OK, nil
+}
+
+// countingTests returns passing implementations of the named tests that count
+// how many times each is run
+// form: runs[test_name]count
+func countingTests(names ...string) (stubs map[string]testFunc, runs func() map[string]int) {
+	var mutex sync.Mutex
+	counts := make(map[string]int)
+
+	stubs = make(map[string]testFunc)
+	for _, name := range names {
+		name := name
+		stubs[name] = func(ctx context.Context, input testInput) (pb.Flag, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			counts[name]++
+			return pb.Flag_OK, nil
+		}
+	}
+
+	return stubs, func() map[string]int {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		snapshot := make(map[string]int)
+		for name, count := range counts {
+			snapshot[name] = count
+		}
+		return snapshot
+	}
+}
+
+func TestRunSubDagDiamond(t *testing.T) {
+	// top depends on left and right, which both depend on bottom
+	dag := dagrid.New_dag()
+	top := dag.Insert_free_node("top")
+	left := dag.Insert_child(top, "left")
+	right := dag.Insert_child(top, "right")
+	dag.Insert_child(left, "bottom")
+	dag.Add_edge(right, dag.IndexLookup["bottom"])
+
+	subdag, err := constructSubDag(dag, []string{"top"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stubs, runs := countingTests("top", "left", "right", "bottom")
+	stubTests(t, stubs)
+
+	// form: completed[test_name]count
+	completed := make(map[string]int)
+	s := newTestServer()
+	err = s.runSubDag(context.Background(), &subdag, map[string]testInfo{}, testInput{}, 0, func(result testResult) error {
+		completed[result.name]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"top", "left", "right", "bottom"} {
+		if runs()[name] != 1 {
+			t.Errorf("%s ran %d times, expected once", name, runs()[name])
+		}
+		if completed[name] != 1 {
+			t.Errorf("%s completed %d times, expected once", name, completed[name])
+		}
+	}
+}
+
+func TestSkippedTestsGetUnrunFlag(t *testing.T) {
+	dag, info, err := buildPipeline(pipelineConfig{Tests: []testConfig{
+		{Name: "top", DependsOn: []string{"bottom"}},
+		{Name: "bottom", SkipDependentsOn: []string{"FAIL"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stubTests(t, map[string]testFunc{
+		"top": passingTest,
+		"bottom": func(ctx context.Context, input testInput) (pb.Flag, error) {
+			return pb.Flag_FAIL, nil
+		},
+	})
+
+	s := newTestServer()
+	s.pipelines[""] = pipeline{dag: dag, info: info}
+	s.unrunFlag = pb.Flag_WARN
+
+	resp, err := s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: 1, Tests: []string{"top"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	top := resp.Flags[1]
+	if top.FlagId != uint32(dag.IndexLookup["top"]) || top.Flag != pb.Flag_WARN || top.ErrorMessage == "" {
+		t.Errorf("skipped test got %s (%q), expected the unrun flag WARN with a reason", top.Flag, top.ErrorMessage)
+	}
+}
+
+func TestRecordedResultsNameTheirTest(t *testing.T) {
+	stubTests(t, map[string]testFunc{"test4": passingTest, "test6": passingTest})
+
+	sink := &collectingSink{}
+	s := newTestServer()
+	s.sinks = []ResultSink{sink}
+	s.pipelines["other"] = s.pipelines[""]
+
+	_, err := s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test4"}, Pipeline: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dag := s.pipelines["other"].dag
+	for _, res := range sink.results {
+		if res.Pipeline != "other" || res.Test != dag.Nodes[res.Resp.FlagId].Contents {
+			t.Errorf("flag %d recorded as test %q of pipeline %q, expected %s of other", res.Resp.FlagId, res.Test, res.Pipeline, dag.Nodes[res.Resp.FlagId].Contents)
+		}
+	}
+}
+
+func TestConstructSubDagIgnoresRequestOrder(t *testing.T) {
+	dag := constructDag()
+
+	// test2 is one of test1's descendants, so is reached from both
+	forwards, err := constructSubDag(dag, []string{"test1", "test2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backwards, err := constructSubDag(dag, []string{"test2", "test1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !dagEqual(&forwards, &backwards) {
+		t.Fatalf("subdags differ:\n%s\n%s", dagString(&forwards), dagString(&backwards))
+	}
+	// the same indices too, so flag ids don't depend on the order either
+	if !reflect.DeepEqual(forwards.IndexLookup, backwards.IndexLookup) {
+		t.Errorf("subdags are numbered differently: %v, %v", forwards.IndexLookup, backwards.IndexLookup)
+	}
+	if !reflect.DeepEqual(sortedLeaves(&forwards), sortedLeaves(&backwards)) {
+		t.Errorf("subdags have different leaves: %v, %v", sortedLeaves(&forwards), sortedLeaves(&backwards))
+	}
+	if len(forwards.Nodes) != len(dag.Nodes) {
+		t.Errorf("subdag has %d tests, expected all %d", len(forwards.Nodes), len(dag.Nodes))
+	}
+}
+
+func TestConstructSubDagOfInteriorTest(t *testing.T) {
+	dag := constructDag()
+
+	// test2 also depends on test4, but isn't part of test4's subdag
+	subdag, err := constructSubDag(dag, []string{"test4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subdag.Nodes) != 2 {
+		t.Errorf("subdag is\n%s\nexpected just test4 and test6", dagString(&subdag))
+	}
+	if edges := dagEdges(&subdag); !reflect.DeepEqual(edges, map[[2]string]bool{{"test4", "test6"}: true}) {
+		t.Errorf("subdag has edges %v, expected only test4 -> test6", edges)
+	}
+	if leaves := leafNames(&subdag); !reflect.DeepEqual(leaves, []string{"test6"}) {
+		t.Errorf("subdag has leaves %v, expected [test6]", leaves)
+	}
+	if err := checkDag(&subdag); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRunSubDagIgnoresLateResults has a test's result arrive a second time,
+// as if from a retry that finished late, after the test above it has started
+func TestRunSubDagIgnoresLateResults(t *testing.T) {
+	dag := dagrid.New_dag()
+	top := dag.Insert_free_node("late_top")
+	dag.Insert_child(top, "late_bottom")
+
+	top_started := make(chan struct{})
+	late_sent := make(chan struct{})
+	stubs, runs := countingTests("late_bottom")
+	stubs["late_top"] = func(ctx context.Context, input testInput) (pb.Flag, error) {
+		close(top_started)
+		select {
+		case <-late_sent:
+		case <-ctx.Done():
+			return pb.Flag_UNSPECIFIED, ctx.Err()
+		}
+		return pb.Flag_OK, nil
+	}
+	stubTests(t, stubs)
+
+	t.Cleanup(func() { runTestFunc = runTest })
+	runTestFunc = func(ctx context.Context, test_name string, input testInput, timeout time.Duration, ch chan<- testResult) {
+		runTest(ctx, test_name, input, timeout, ch)
+		if test_name != "late_bottom" {
+			return
+		}
+
+		defer close(late_sent)
+		select {
+		case <-top_started:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case ch <- testResult{name: test_name, flag: pb.Flag_FAIL}:
+		case <-ctx.Done():
+		}
+	}
+
+	// form: completions[test_name]count
+	completions := make(map[string]int)
+	err := newTestServer().runSubDag(context.Background(), &dag, map[string]testInfo{}, testInput{}, 0, func(result testResult) error {
+		completions[result.name]++
+		if result.name == "late_bottom" && result.flag != pb.Flag_OK {
+			t.Errorf("late_bottom completed with the late %s", result.flag)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(completions, map[string]int{"late_top": 1, "late_bottom": 1}) {
+		t.Errorf("tests completed %v times, expected once each", completions)
+	}
+	if runs()["late_bottom"] != 1 {
+		t.Errorf("late_bottom ran %d times, expected once", runs()["late_bottom"])
+	}
+}
+
+// TestRunSubDagWide runs a wide fan out and back in, with many tests finishing
+// at once. It is mostly there for go test -race, to show the scheduling state
+// in runSubDag is only touched from one goroutine.
+func TestRunSubDagWide(t *testing.T) {
+	const width = 200
+
+	// top depends on every middle test, which all depend on bottom
+	dag := dagrid.New_dag()
+	top := dag.Insert_free_node("wide_top")
+	bottom := -1
+	names := []string{"wide_top", "wide_bottom"}
+	for i := 0; i < width; i++ {
+		name := fmt.Sprintf("wide_%03d", i)
+		middle := dag.Insert_child(top, name)
+		if bottom < 0 {
+			bottom = dag.Insert_child(middle, "wide_bottom")
+		} else {
+			dag.Add_edge(middle, bottom)
+		}
+		names = append(names, name)
+	}
+	dropStaleLeaves(&dag)
+
+	stubs, runs := countingTests(names...)
+	stubTests(t, stubs)
+
+	s := newTestServer()
+	s.testLimiter = newTestLimiter(16)
+
+	completed := 0
+	err := s.runSubDag(context.Background(), &dag, map[string]testInfo{}, testInput{}, 32, func(result testResult) error {
+		completed++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if completed != len(names) {
+		t.Errorf("%d tests completed, expected %d", completed, len(names))
+	}
+	for _, name := range names {
+		if runs()[name] != 1 {
+			t.Errorf("%s ran %d times, expected once", name, runs()[name])
+		}
+	}
+}
+
+func TestChangedTestsNeedResultsDb(t *testing.T) {
+	stubTests(t, map[string]testFunc{"test4": passingTest, "test6": passingTest})
+
+	s := newTestServer()
+	_, err := s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test4"}, ChangedTests: []string{"test4"}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, expected FailedPrecondition", err)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	cases := []struct {
+		name string
+		in   *pb.ValidateOneRequest
+		ok   bool
+	}{
+		{"valid", &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test1", "test2"}}, true},
+		{"no tests", &pb.ValidateOneRequest{DataId: 1}, false},
+		{"empty test name", &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test1", ""}}, false},
+		{"duplicate test", &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test1", "test2", "test1"}}, false},
+		{"no data id", &pb.ValidateOneRequest{Tests: []string{"test1"}}, false},
+		{"negative timeout", &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test1"}, Timeout: durationpb.New(-time.Second)}, false},
+	}
+
+	for _, c := range cases {
+		err := validateRequest(c.in)
+		if c.ok && err != nil {
+			t.Errorf("%s: got %v, expected no error", c.name, err)
+		}
+		if !c.ok && status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v, expected InvalidArgument", c.name, err)
+		}
+	}
+}
+
+func TestRecordedResultsHaveTheirObservation(t *testing.T) {
+	stubTests(t, map[string]testFunc{"test4": passingTest, "test6": passingTest})
+
+	sink := &collectingSink{}
+	s := newTestServer()
+	s.sinks = []ResultSink{sink}
+
+	noon := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	_, err := s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: 1, StationId: 18700, StartTime: timestamppb.New(noon), Tests: []string{"test4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, res := range sink.results {
+		if res.StationId != 18700 || !res.ObsTime.Equal(noon) {
+			t.Errorf("%s recorded for station %d at %v, expected 18700 at %v", res.Test, res.StationId, res.ObsTime, noon)
+		}
+	}
+}
+
+func TestIdempotencyKeyReplaysResults(t *testing.T) {
+	stubs, runs := countingTests("test4", "test6")
+	stubTests(t, stubs)
+
+	s := newTestServer()
+	in := &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test4"}, IdempotencyKey: "retry-me"}
+
+	first, err := s.ValidateOneSync(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.ValidateOneSync(context.Background(), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(runs(), map[string]int{"test4": 1, "test6": 1}) {
+		t.Errorf("tests ran %v times, expected once each", runs())
+	}
+	if len(second.Flags) != len(first.Flags) {
+		t.Fatalf("retry got %d responses, expected the first run's %d", len(second.Flags), len(first.Flags))
+	}
+	for i := range first.Flags {
+		if second.Flags[i] != first.Flags[i] {
+			t.Errorf("response %d of the retry isn't the cached one", i)
+		}
+	}
+}
+
+func TestIdempotencyKeyReusedForAnotherRequest(t *testing.T) {
+	stubTests(t, map[string]testFunc{"test4": passingTest, "test5": passingTest, "test6": passingTest})
+
+	s := newTestServer()
+	_, err := s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test4"}, IdempotencyKey: "reused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.ValidateOneSync(context.Background(), &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test5"}, IdempotencyKey: "reused"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v, expected InvalidArgument", err)
+	}
+}
+
+func TestIdempotencyKeyExpires(t *testing.T) {
+	stubs, runs := countingTests("test4", "test6")
+	stubTests(t, stubs)
+
+	s := newTestServer()
+	s.cache = newResultCache(time.Millisecond)
+	in := &pb.ValidateOneRequest{DataId: 1, Tests: []string{"test4"}, IdempotencyKey: "short-lived"}
+
+	if _, err := s.ValidateOneSync(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, err := s.ValidateOneSync(context.Background(), in); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(runs(), map[string]int{"test4": 2, "test6": 2}) {
+		t.Errorf("tests ran %v times, expected twice each once the first run expired", runs())
+	}
+}
+
+func TestFailFastAbortsOnError(t *testing.T) {
+	// top depends on bad and slow. bad errors straight away, while slow runs
+	// until it is cancelled
+	dag, info, err := buildPipeline(pipelineConfig{Tests: []testConfig{
+		{Name: "top", DependsOn: []string{"bad", "slow"}},
+		{Name: "bad"},
+		{Name: "slow"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stubs, runs := countingTests("top")
+	slow_cancelled := make(chan struct{})
+	stubs["bad"] = func(ctx context.Context, input testInput) (pb.Flag, error) {
+		return pb.Flag_UNSPECIFIED, fmt.Errorf("broken")
+	}
+	stubs["slow"] = func(ctx context.Context, input testInput) (pb.Flag, error) {
+		<-ctx.Done()
+		close(slow_cancelled)
+		return pb.Flag_UNSPECIFIED, ctx.Err()
+	}
+	stubTests(t, stubs)
+
+	sink := &collectingSink{}
+	s := newTestServer()
+	s.pipelines[""] = pipeline{dag: dag, info: info}
+	s.sinks = []ResultSink{sink}
+
+	stream := &recordingStream{}
+	err = s.ValidateOne(&pb.ValidateOneRequest{DataId: 1, Tests: []string{"top"}, FailFast: true}, stream)
+	if status.Code(err) != codes.Aborted {
+		t.Fatalf("got error %v, expected ABORTED", err)
+	}
+
+	// the rest of the validation is called off
+	select {
+	case <-slow_cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow test still running after the validation was aborted")
+	}
+	if runs()["top"] != 0 {
+		t.Errorf("top ran %d times after the validation was aborted, expected never", runs()["top"])
+	}
+
+	// all or nothing, so none of the flags held back are sent or recorded
+	if len(stream.sent) != 0 {
+		t.Errorf("sent %d responses on an aborted validation, expected none", len(stream.sent))
+	}
+	if len(sink.results) != 0 {
+		t.Errorf("recorded %d results of an aborted validation, expected none", len(sink.results))
+	}
+}
+
+func TestFailFastDeliversHeldFlags(t *testing.T) {
+	stubs, _ := countingTests("test1", "test2", "test3", "test4", "test5", "test6")
+	stubTests(t, stubs)
+
+	sink := &collectingSink{}
+	s := newTestServer()
+	s.sinks = []ResultSink{sink}
+
+	stream := &recordingStream{}
+	if err := s.ValidateOne(&pb.ValidateOneRequest{DataId: 1, Tests: []string{"test1"}, FailFast: true}, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	// every flag, then the completion
+	if len(stream.sent) != 7 {
+		t.Fatalf("sent %d responses, expected 6 flags and the completion", len(stream.sent))
+	}
+	for _, resp := range stream.sent[:6] {
+		if resp.Flag != pb.Flag_OK || resp.Complete {
+			t.Errorf("sent %v, expected an OK flag", resp)
+		}
+	}
+	if !stream.sent[6].Complete {
+		t.Errorf("last response is %v, expected the completion", stream.sent[6])
+	}
+	if len(sink.results) != 6 {
+		t.Errorf("recorded %d results, expected 6", len(sink.results))
+	}
+}
@@ -0,0 +1,105 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// memorySource serves observations from a fixture loaded into memory, for
+// testing and offline runs without a data backend
+type memorySource struct {
+	// form: observations[memoryKey(data_id, station_id, time)]values
+	observations map[string][]float64
+}
+
+// memoryKey identifies the observations for data_id at station_id and t. A
+// zero station_id stands for observations at any station, and a zero t for
+// observations with no time.
+func memoryKey(data_id uint32, station_id uint32, t time.Time) string {
+	if t.IsZero() {
+		return fmt.Sprintf("%d %d", data_id, station_id)
+	}
+	return fmt.Sprintf("%d %d %s", data_id, station_id, t.UTC().Format(time.RFC3339Nano))
+}
+
+// loadMemorySource reads a CSV fixture with rows of
+//
+//	data_id,time,value[,station_id]
+//
+// where time is RFC 3339, or empty for observations used when a request has no
+// time range. Rows without a station_id are observed at every station, unless
+// the station has rows of its own for the same data_id and time. Rows with
+// the same data_id, time and station_id add up to multiple values.
+func loadMemorySource(path string) (*memorySource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	// checked below, since the station_id is optional
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+
+	source := &memorySource{observations: make(map[string][]float64)}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) != 3 && len(record) != 4 {
+			return nil, fmt.Errorf("%s:%d: expected 3 or 4 fields, got %d", path, line, len(record))
+		}
+		data_id, err := strconv.ParseUint(record[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid data_id: %v", path, line, err)
+		}
+		var t time.Time
+		if record[1] != "" {
+			t, err = time.Parse(time.RFC3339, record[1])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid time: %v", path, line, err)
+			}
+		}
+		value, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid value: %v", path, line, err)
+		}
+
+		var station_id uint64
+		if len(record) == 4 {
+			station_id, err = strconv.ParseUint(record[3], 10, 32)
+			if err != nil || station_id == 0 {
+				return nil, fmt.Errorf("%s:%d: invalid station_id %q", path, line, record[3])
+			}
+		}
+
+		key := memoryKey(uint32(data_id), uint32(station_id), t)
+		source.observations[key] = append(source.observations[key], value)
+	}
+
+	return source, nil
+}
+
+func (source *memorySource) Fetch(ctx context.Context, data_id uint32, station_id uint32, t time.Time) ([]float64, error) {
+	values, ok := source.observations[memoryKey(data_id, station_id, t)]
+	if !ok {
+		values, ok = source.observations[memoryKey(data_id, 0, t)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w for data %d at station %d at %s in fixture", errNoObservation, data_id, station_id, t.UTC().Format(time.RFC3339))
+	}
+
+	return values, nil
+}
@@ -0,0 +1,94 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMemorySource(t *testing.T) {
+	source, err := loadMemorySource("testdata/observations.csv")
+	if err != nil {
+		t.Fatalf("failed to load fixture: %v", err)
+	}
+
+	noon := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name       string
+		data_id    uint32
+		station_id uint32
+		t          time.Time
+		values     []float64
+	}{
+		// the second row's time is the same instant in another zone
+		{"rows at the same time add up", 42, 0, noon, []float64{1.5, 2}},
+		{"looked up in another zone", 42, 0, noon.In(time.FixedZone("CET", 3600)), []float64{1.5, 2}},
+		{"next hour", 42, 0, noon.Add(time.Hour), []float64{2.5}},
+		{"no time", 42, 0, time.Time{}, []float64{-3.25}},
+		{"zero value", 43, 0, noon, []float64{0}},
+		{"rows without a station are at every station", 42, 18700, noon, []float64{1.5, 2}},
+		{"at one station", 42, 18700, noon.Add(2 * time.Hour), []float64{7}},
+		{"station's own row", 43, 18700, noon, []float64{-1}},
+		{"other stations", 43, 18701, noon, []float64{0}},
+	}
+
+	for _, c := range cases {
+		values, err := source.Fetch(context.Background(), c.data_id, c.station_id, c.t)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !reflect.DeepEqual(values, c.values) {
+			t.Errorf("%s: got values %v, expected %v", c.name, values, c.values)
+		}
+	}
+
+	for _, station_id := range []uint32{0, 18701} {
+		if values, err := source.Fetch(context.Background(), 42, station_id, noon.Add(2*time.Hour)); !errors.Is(err, errNoObservation) {
+			t.Errorf("got values %v and error %v for station %d, which has no observation in the fixture, expected %v", values, err, station_id, errNoObservation)
+		}
+	}
+	if values, err := source.Fetch(context.Background(), 43, 0, time.Time{}); !errors.Is(err, errNoObservation) {
+		t.Errorf("got values %v and error %v for an observation not in the fixture, expected %v", values, err, errNoObservation)
+	}
+}
+
+func TestLoadMemorySourceBadRows(t *testing.T) {
+	cases := []struct {
+		name string
+		csv  string
+		// expected in the error, along with the line number
+		message string
+	}{
+		{"bad data_id", "42,,1\nx,,1\n", "2: invalid data_id"},
+		{"negative data_id", "-42,,1\n", "1: invalid data_id"},
+		{"bad time", "42,,1\n42,,1\n42,yesterday,1\n", "3: invalid time"},
+		{"time without a zone", "42,2022-01-01T12:00:00,1\n", "1: invalid time"},
+		{"bad value", "# comment\n42,,one\n", "2: invalid value"},
+		{"missing value", "42,\n", "1: expected 3 or 4 fields"},
+		{"bad station_id", "42,,1,SN18700\n", "1: invalid station_id"},
+		{"zero station_id", "42,,1,0\n", "1: invalid station_id"},
+		{"too many fields", "42,,1,18700,x\n", "1: expected 3 or 4 fields"},
+	}
+
+	for _, c := range cases {
+		path := filepath.Join(t.TempDir(), "bad.csv")
+		if err := os.WriteFile(path, []byte(c.csv), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := loadMemorySource(path)
+		if err == nil {
+			t.Errorf("%s: loaded, expected an error", c.name)
+		} else if !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: error is %q, expected it to contain %q", c.name, err, c.message)
+		}
+	}
+
+	if _, err := loadMemorySource(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Errorf("loaded a file that doesn't exist, expected an error")
+	}
+}
@@ -0,0 +1,48 @@
+package coordinator
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// pipelineMetrics are gauges of the shape of each pipeline, served as
+// "pipelines" on the metrics endpoint's /debug/vars, e.g.
+// {"pipelines": {"default": {"depth": 4, "width": 2}}}. the default pipeline
+// is named default.
+var pipelineMetrics = expvar.NewMap("pipelines")
+
+// publishPipelineMetrics sets the depth and width gauges of each of the given
+// pipelines, leaving the gauges of any others as they are
+// form: pipelines[pipeline_name]pipeline
+func publishPipelineMetrics(pipelines map[string]pipeline) {
+	for name, p := range pipelines {
+		if name == "" {
+			name = "default"
+		}
+
+		depth := new(expvar.Int)
+		depth.Set(int64(dagDepth(&p.dag)))
+		width := new(expvar.Int)
+		width.Set(int64(dagMaxWidth(&p.dag)))
+
+		gauges := new(expvar.Map).Init()
+		gauges.Set("depth", depth)
+		gauges.Set("width", width)
+		pipelineMetrics.Set(name, gauges)
+	}
+}
+
+// serveMetrics serves the metrics as JSON on address at /debug/vars, in the
+// background. the coordinator keeps running without them if this fails.
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		log.Printf("metrics listening at %s", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			log.Printf("failed to serve metrics: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+package coordinator
+
+import (
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pipelineGauge reads one of a pipeline's gauges off the metrics
+func pipelineGauge(t *testing.T, pipeline_name string, gauge string) int64 {
+	t.Helper()
+	gauges, ok := pipelineMetrics.Get(pipeline_name).(*expvar.Map)
+	if !ok {
+		t.Fatalf("no metrics for pipeline %s", pipeline_name)
+	}
+	value, ok := gauges.Get(gauge).(*expvar.Int)
+	if !ok {
+		t.Fatalf("no %s gauge for pipeline %s", gauge, pipeline_name)
+	}
+	return value.Value()
+}
+
+func TestReloadPublishesPipelineMetrics(t *testing.T) {
+	s := newTestServer()
+	publishPipelineMetrics(s.pipelines)
+	if depth, width := pipelineGauge(t, "default", "depth"), pipelineGauge(t, "default", "width"); depth != 4 || width != 2 {
+		t.Errorf("default pipeline has depth=%d width=%d, expected depth=4 width=2", depth, width)
+	}
+
+	// a chain of three tests, and a fourth on its own
+	path := filepath.Join(t.TempDir(), "chain.json")
+	config := `{"tests": [
+		{"name": "test1", "depends_on": ["test2"]},
+		{"name": "test2", "depends_on": ["test3"]},
+		{"name": "test3"},
+		{"name": "test4"}
+	]}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.reloadPipelines(map[string]string{"chain": path}); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if depth, width := pipelineGauge(t, "chain", "depth"), pipelineGauge(t, "chain", "width"); depth != 3 || width != 2 {
+		t.Errorf("chain pipeline has depth=%d width=%d, expected depth=3 width=2", depth, width)
+	}
+	// pipelines that weren't reloaded keep their gauges
+	if depth := pipelineGauge(t, "default", "depth"); depth != 4 {
+		t.Errorf("default pipeline's depth is %d after reloading another, expected 4", depth)
+	}
+}
@@ -0,0 +1,243 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/intarga/dagrid"
+	pb "github.com/metno/rove/proto"
+	"os"
+	"strings"
+	"time"
+)
+
+// pipelineConfig is the JSON form of a pipeline, the tests the coordinator
+// knows about and how they depend on each other, e.g.
+//
+//	{"tests": [
+//	  {"name": "test1", "description": "...", "severity": "HIGH", "depends_on": ["test2"], "timeout": "30s"},
+//	  {"name": "test2", "description": "...", "severity": "LOW", "skip_dependents_on": ["FAIL"]},
+//	  {"name": "test3", "description": "...", "severity": "LOW", "groups": ["temperature"], "parameters": {"max": 40}}
+//	]}
+type pipelineConfig struct {
+	Tests []testConfig `json:"tests"`
+}
+
+type testConfig struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// one of LOW, MEDIUM or HIGH, LOW if empty
+	Severity string   `json:"severity"`
+	Groups   []string `json:"groups"`
+	Priority int      `json:"priority"`
+	// tests that have to run before this one, its children in the dag
+	DependsOn []string `json:"depends_on"`
+	// configuration for the test, like thresholds or window sizes
+	Parameters map[string]float64 `json:"parameters"`
+	// flags that, if the test gives them, mean the tests depending on it
+	// aren't run, e.g. FAIL
+	SkipDependentsOn []string `json:"skip_dependents_on"`
+	// how long the test can run before it is cancelled and gives ERROR, as a
+	// Go duration like "30s". no limit if empty
+	Timeout string `json:"timeout"`
+}
+
+// loadPipeline reads a pipeline from the JSON file at path, returning the dag
+// and test info that would otherwise come from constructDag and
+// constructTestInfo
+func loadPipeline(path string) (dagrid.Dag, map[string]testInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return dagrid.Dag{}, nil, err
+	}
+	defer file.Close()
+
+	var config pipelineConfig
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return dagrid.Dag{}, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	dag, info, err := buildPipeline(config)
+	if err != nil {
+		return dagrid.Dag{}, nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return dag, info, nil
+}
+
+// buildPipeline turns a parsed pipeline config into a dag and test info
+func buildPipeline(config pipelineConfig) (dagrid.Dag, map[string]testInfo, error) {
+	dag := dagrid.New_dag()
+	info := make(map[string]testInfo)
+
+	if len(config.Tests) == 0 {
+		return dagrid.Dag{}, nil, fmt.Errorf("pipeline has no tests")
+	}
+
+	// every test goes in first, so dependencies can be listed in any order
+	for _, test := range config.Tests {
+		if test.Name == "" {
+			return dagrid.Dag{}, nil, fmt.Errorf("test with no name")
+		}
+		if _, ok := info[test.Name]; ok {
+			return dagrid.Dag{}, nil, fmt.Errorf("test %s defined twice", test.Name)
+		}
+
+		severity := pb.Severity_LOW
+		if test.Severity != "" {
+			value, ok := pb.Severity_value[strings.ToUpper(test.Severity)]
+			if !ok || value == int32(pb.Severity_SEVERITY_UNSPECIFIED) {
+				return dagrid.Dag{}, nil, fmt.Errorf("test %s has unknown severity %q, expected LOW, MEDIUM or HIGH", test.Name, test.Severity)
+			}
+			severity = pb.Severity(value)
+		}
+
+		var skip_dependents_on []pb.Flag
+		for _, name := range test.SkipDependentsOn {
+			value, ok := pb.Flag_value[strings.ToUpper(name)]
+			if !ok || value == int32(pb.Flag_UNSPECIFIED) {
+				return dagrid.Dag{}, nil, fmt.Errorf("test %s skips dependents on unknown flag %q", test.Name, name)
+			}
+			skip_dependents_on = append(skip_dependents_on, pb.Flag(value))
+		}
+
+		var timeout time.Duration
+		if test.Timeout != "" {
+			var err error
+			timeout, err = time.ParseDuration(test.Timeout)
+			if err != nil || timeout <= 0 {
+				return dagrid.Dag{}, nil, fmt.Errorf("test %s has invalid timeout %q", test.Name, test.Timeout)
+			}
+		}
+
+		dag.Insert_free_node(test.Name)
+		info[test.Name] = testInfo{
+			description:      test.Description,
+			severity:         severity,
+			groups:           test.Groups,
+			priority:         test.Priority,
+			params:           test.Parameters,
+			skipDependentsOn: skip_dependents_on,
+			timeout:          timeout,
+		}
+	}
+
+	for _, test := range config.Tests {
+		for _, dependency := range test.DependsOn {
+			if _, ok := info[dependency]; !ok {
+				return dagrid.Dag{}, nil, fmt.Errorf("test %s depends on unknown test %s", test.Name, dependency)
+			}
+			if err := addEdgeByName(&dag, test.Name, dependency); err != nil {
+				return dagrid.Dag{}, nil, err
+			}
+		}
+	}
+
+	return dag, info, nil
+}
+
+// checkPipeline reports why the tests in dag can't be run, if they can't
+func checkPipeline(dag *dagrid.Dag) error {
+	if err := checkDag(dag); err != nil {
+		return err
+	}
+	if missing := unimplementedTests(dag); len(missing) > 0 {
+		return fmt.Errorf("tests in the dag have no implementation: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// pipeline is a dag of tests along with their metadata
+type pipeline struct {
+	dag  dagrid.Dag
+	info map[string]testInfo
+}
+
+// loadPipelines loads and checks the pipeline files, by pipeline name. It
+// fails if any of them can't be used.
+// form: files[pipeline_name]path
+func loadPipelines(files map[string]string) (map[string]pipeline, error) {
+	pipelines := make(map[string]pipeline)
+	for name, path := range files {
+		dag, info, err := loadPipeline(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPipeline(&dag); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		pipelines[name] = pipeline{dag: dag, info: info}
+	}
+
+	return pipelines, nil
+}
+
+// parsePipelineFiles parses a comma separated list of name=path pairs
+// form: files[pipeline_name]path
+func parsePipelineFiles(s string) (map[string]string, error) {
+	files := make(map[string]string)
+	if s == "" {
+		return files, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid pipeline %q, expected name=path", pair)
+		}
+		if _, ok := files[parts[0]]; ok {
+			return nil, fmt.Errorf("pipeline %s given twice", parts[0])
+		}
+		if parts[0] == seriesPipeline || parts[0] == spatialPipeline {
+			return nil, fmt.Errorf("pipeline can't be called %s, the name is kept for %s results", parts[0], parts[0])
+		}
+		files[parts[0]] = parts[1]
+	}
+
+	return files, nil
+}
+
+// currentPipeline returns the dag and test info of the pipeline called name,
+// or the default pipeline if name is empty. They are only ever replaced
+// whole, never modified, so they can be used after the lock is released.
+func (s *server) currentPipeline(name string) (dagrid.Dag, map[string]testInfo, error) {
+	s.pipelineMutex.RLock()
+	defer s.pipelineMutex.RUnlock()
+
+	p, ok := s.pipelines[name]
+	if !ok {
+		return dagrid.Dag{}, nil, fmt.Errorf("unknown pipeline %q", name)
+	}
+
+	return p.dag, p.info, nil
+}
+
+// reloadPipelines loads the pipeline files and, if they are all valid, swaps
+// them in for validations started from now on. Pipelines without a file are
+// left as they are.
+// form: files[pipeline_name]path
+func (s *server) reloadPipelines(files map[string]string) error {
+	pipelines, err := loadPipelines(files)
+	if err != nil {
+		return err
+	}
+
+	s.pipelineMutex.Lock()
+	defer s.pipelineMutex.Unlock()
+
+	// copied rather than updated in place, so the map is never modified
+	// while currentPipeline's callers might still be reading it
+	updated := make(map[string]pipeline, len(s.pipelines))
+	for name, p := range s.pipelines {
+		updated[name] = p
+	}
+	for name, p := range pipelines {
+		updated[name] = p
+	}
+	s.pipelines = updated
+	publishPipelineMetrics(pipelines)
+
+	return nil
+}
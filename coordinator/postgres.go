@@ -0,0 +1,154 @@
+package coordinator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	pb "github.com/metno/rove/proto"
+	"log"
+	"time"
+)
+
+// how many results can be waiting to be written before new ones are dropped
+const postgresQueueSize = 1024
+
+// postgresSink stores results in a postgres/timescale table with the columns
+//
+//	request_id text, data_id bigint, station_id bigint, obs_time timestamptz,
+//	pipeline text, test text, flag_id bigint, flag bigint, time timestamptz
+//
+// obs_time is the time of the observation the flag is for, NULL if the
+// request didn't give one, and time is when the flag was produced. The test
+// is stored by name as well as flag id, since flag ids are only meaningful
+// within the pipeline that produced them, as it was at the time.
+//
+// Results are queued and written by a background goroutine. If the queue is
+// full they are dropped with a warning rather than stalling the validation.
+type postgresSink struct {
+	db    *sql.DB
+	query string
+	// reads stored results back, see flags
+	flagsQuery string
+	queue      chan Result
+	done       chan struct{}
+}
+
+func newPostgresSink(conn_str string, table string) (*postgresSink, error) {
+	db, err := sql.Open("postgres", conn_str)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot connect to results db: %v", err)
+	}
+
+	sink := &postgresSink{
+		db: db,
+		query: fmt.Sprintf(
+			"INSERT INTO %s (request_id, data_id, station_id, obs_time, pipeline, test, flag_id, flag, time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+			pq.QuoteIdentifier(table),
+		),
+		flagsQuery: fmt.Sprintf(
+			"SELECT request_id, station_id, obs_time, pipeline, test, flag_id, flag, time FROM %s WHERE data_id = $1 ORDER BY time, flag_id",
+			pq.QuoteIdentifier(table),
+		),
+		queue: make(chan Result, postgresQueueSize),
+		done:  make(chan struct{}),
+	}
+	go sink.run()
+
+	return sink, nil
+}
+
+func (sink *postgresSink) run() {
+	defer close(sink.done)
+
+	for res := range sink.queue {
+		_, err := sink.db.Exec(sink.query, insertArgs(res)...)
+		if err != nil {
+			log.Printf("failed to store result for request %s: %v", res.RequestId, err)
+		}
+	}
+}
+
+// insertArgs returns the values of the columns stored for res, in the order
+// of postgresSink's insert query
+func insertArgs(res Result) []interface{} {
+	obs_time := sql.NullTime{Time: res.ObsTime, Valid: !res.ObsTime.IsZero()}
+	return []interface{}{res.RequestId, res.Resp.DataId, res.StationId, obs_time, res.Pipeline, res.Test, res.Resp.FlagId, res.Resp.Flag, res.Time}
+}
+
+func (sink *postgresSink) Write(res Result) {
+	select {
+	case sink.queue <- res:
+	default:
+		log.Printf("results db queue full, dropping result for request %s", res.RequestId)
+	}
+}
+
+// storedFlag is a result read back from the results db
+type storedFlag struct {
+	requestId string
+	stationId uint32
+	// zero if the request didn't give an observation time
+	obsTime  time.Time
+	pipeline string
+	test     string
+	flagId   uint32
+	flag     pb.Flag
+	time     time.Time
+}
+
+// lastFlags returns the newest of flags for each test of the pipeline called
+// pipeline_name, for the observation at station_id and obs_time, keyed by test
+// name. Series and spatial results are never included, since they don't come
+// from a pipeline's dag. flags must be oldest first, as returned by
+// postgresSink.flags
+func lastFlags(flags []storedFlag, pipeline_name string, station_id uint32, obs_time time.Time) map[string]storedFlag {
+	// form: last[test_name]flag
+	last := make(map[string]storedFlag)
+	for _, row := range flags {
+		if row.pipeline == seriesPipeline || row.pipeline == spatialPipeline {
+			continue
+		}
+		if row.pipeline == pipeline_name && row.stationId == station_id && row.obsTime.Equal(obs_time) {
+			last[row.test] = row
+		}
+	}
+
+	return last
+}
+
+// flags returns every stored result for data_id, oldest first. Results still
+// queued for writing aren't included.
+func (sink *postgresSink) flags(ctx context.Context, data_id uint32) ([]storedFlag, error) {
+	rows, err := sink.db.QueryContext(ctx, sink.flagsQuery, data_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var flags []storedFlag
+	for rows.Next() {
+		var row storedFlag
+		var obs_time sql.NullTime
+		if err := rows.Scan(&row.requestId, &row.stationId, &obs_time, &row.pipeline, &row.test, &row.flagId, &row.flag, &row.time); err != nil {
+			return nil, err
+		}
+		if obs_time.Valid {
+			row.obsTime = obs_time.Time
+		}
+		flags = append(flags, row)
+	}
+
+	return flags, rows.Err()
+}
+
+func (sink *postgresSink) Close() error {
+	close(sink.queue)
+	<-sink.done
+
+	return sink.db.Close()
+}
@@ -0,0 +1,66 @@
+package coordinator
+
+import (
+	"database/sql"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLastFlagsKeepsNewestPerTest(t *testing.T) {
+	noon := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	flags := []storedFlag{
+		{requestId: "a", stationId: 18700, obsTime: noon, test: "test4", flag: pb.Flag_FAIL},
+		{requestId: "a", stationId: 18700, obsTime: noon, test: "test6", flag: pb.Flag_OK},
+		{requestId: "b", stationId: 18700, obsTime: noon, pipeline: "other", test: "test4", flag: pb.Flag_ERROR},
+		{requestId: "c", stationId: 18700, obsTime: noon, test: "test4", flag: pb.Flag_OK},
+		// the same tests on other observations
+		{requestId: "d", stationId: 18701, obsTime: noon, test: "test4", flag: pb.Flag_FAIL},
+		{requestId: "e", stationId: 18700, obsTime: noon.Add(time.Hour), test: "test6", flag: pb.Flag_FAIL},
+		// series and spatial tests that happen to share a name
+		{requestId: "f", stationId: 18700, obsTime: noon, pipeline: seriesPipeline, test: "test4", flag: pb.Flag_FAIL},
+		{requestId: "g", stationId: 18700, obsTime: noon, pipeline: spatialPipeline, test: "test6", flag: pb.Flag_FAIL},
+	}
+
+	last := lastFlags(flags, "", 18700, noon)
+	if len(last) != 2 {
+		t.Fatalf("got flags for %d tests, expected 2", len(last))
+	}
+	if last["test4"].requestId != "c" {
+		t.Errorf("test4's flag is from request %s, expected c", last["test4"].requestId)
+	}
+	if last["test6"].requestId != "a" {
+		t.Errorf("test6's flag is from request %s, expected a", last["test6"].requestId)
+	}
+
+	for _, pipeline_name := range []string{seriesPipeline, spatialPipeline} {
+		if stored := lastFlags(flags, pipeline_name, 18700, noon); len(stored) != 0 {
+			t.Errorf("got %v for %s, expected no flags to replay", stored, pipeline_name)
+		}
+	}
+
+	if other := lastFlags(flags, "", 18701, noon); len(other) != 1 || other["test4"].requestId != "d" {
+		t.Errorf("flags for station 18701 are %v, expected only request d's test4", other)
+	}
+}
+
+func TestInsertArgsIncludeObservation(t *testing.T) {
+	noon := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := time.Now()
+
+	resp := &pb.ValidateResponse{DataId: 42, StationId: 18700, FlagId: 3, Flag: pb.Flag_OK, Time: timestamppb.New(noon)}
+	res := Result{RequestId: "a", Test: "test4", Time: now, StationId: 18700, ObsTime: noon, Resp: resp}
+
+	expected := []interface{}{"a", uint32(42), uint32(18700), sql.NullTime{Time: noon, Valid: true}, "", "test4", uint32(3), pb.Flag_OK, now}
+	if args := insertArgs(res); !reflect.DeepEqual(args, expected) {
+		t.Errorf("insert args are %v, expected %v", args, expected)
+	}
+
+	// no observation time is stored as NULL, not the zero time
+	res.ObsTime = time.Time{}
+	if obs_time := insertArgs(res)[3].(sql.NullTime); obs_time.Valid {
+		t.Errorf("obs_time is %v for a result without one, expected NULL", obs_time.Time)
+	}
+}
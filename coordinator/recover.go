@@ -0,0 +1,31 @@
+package coordinator
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"log"
+	"runtime/debug"
+)
+
+// recoverHandler turns a panic in a handler into an Internal error, logging
+// the stack trace, so one bad request can't take down the coordinator
+func recoverHandler(method string, err *error) {
+	if r := recover(); r != nil {
+		log.Printf("panic in %s: %v\n%s", method, r, debug.Stack())
+		*err = status.Errorf(codes.Internal, "internal error in %s", method)
+	}
+}
+
+func recoveryUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer recoverHandler(info.FullMethod, &err)
+
+	return handler(ctx, req)
+}
+
+func recoveryStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer recoverHandler(info.FullMethod, &err)
+
+	return handler(srv, ss)
+}
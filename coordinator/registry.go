@@ -0,0 +1,94 @@
+package coordinator
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// activeValidation is what the registry knows about a running validation
+type activeValidation struct {
+	requestId string
+	cancel    context.CancelFunc
+	dataId    uint32
+	tests     []string
+	start     time.Time
+	// how many of total tests have completed
+	completed int
+	total     int
+}
+
+// validationRegistry keeps track of the validations that are currently
+// running, so they can be listed, and cancelled by their request id
+type validationRegistry struct {
+	mutex sync.Mutex
+	// form: active[request_id]validation
+	active map[string]*activeValidation
+}
+
+func newValidationRegistry() *validationRegistry {
+	return &validationRegistry{active: make(map[string]*activeValidation)}
+}
+
+// add registers a validation. It returns false if a validation with the same
+// id is already running.
+func (r *validationRegistry) add(validation *activeValidation) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.active[validation.requestId]; ok {
+		return false
+	}
+	r.active[validation.requestId] = validation
+
+	return true
+}
+
+// remove unregisters a validation once it is finished
+func (r *validationRegistry) remove(request_id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.active, request_id)
+}
+
+// cancel cancels a running validation. It returns false if there is no
+// validation with that id.
+func (r *validationRegistry) cancel(request_id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	validation, ok := r.active[request_id]
+	if ok {
+		validation.cancel()
+	}
+
+	return ok
+}
+
+// progress records how many tests a running validation has completed
+func (r *validationRegistry) progress(request_id string, completed int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if validation, ok := r.active[request_id]; ok {
+		validation.completed = completed
+	}
+}
+
+// list returns a snapshot of the running validations, oldest first
+func (r *validationRegistry) list() []activeValidation {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	validations := make([]activeValidation, 0, len(r.active))
+	for _, validation := range r.active {
+		validations = append(validations, *validation)
+	}
+	sort.Slice(validations, func(i, j int) bool {
+		return validations[i].start.Before(validations[j].start)
+	})
+
+	return validations
+}
@@ -0,0 +1,105 @@
+package coordinator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"log"
+	"time"
+)
+
+// newRequestId generates a random id used to tie together everything that
+// happens as part of a single validation
+func newRequestId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("failed to generate request id: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestIdHeader is the grpc metadata key a request id is passed in, both
+// from clients that set it and back to them
+const requestIdHeader = "x-request-id"
+
+// incomingRequestId returns the request id the client set in the call's
+// metadata, if any
+func incomingRequestId(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	ids := md.Get(requestIdHeader)
+	if len(ids) == 0 {
+		return ""
+	}
+	return ids[0]
+}
+
+// the most time steps a single request can cover
+const maxTimeSteps = 10000
+
+// requestTimes returns the times a request should be validated at. If the
+// request doesn't have a time range that is a single zero time. If the
+// request has values, there must be one for every time in a range.
+func requestTimes(in *pb.ValidateOneRequest) ([]time.Time, error) {
+	if in.StartTime == nil {
+		if in.EndTime != nil || in.Step != nil {
+			return nil, errors.New("end_time and step need a start_time")
+		}
+		return []time.Time{{}}, nil
+	}
+
+	start := in.StartTime.AsTime()
+	if in.EndTime == nil {
+		return []time.Time{start}, nil
+	}
+
+	times, err := timeRange(start, in.EndTime.AsTime(), in.Step.AsDuration())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(in.Values) > 0 && len(in.Values) != len(times) {
+		return nil, fmt.Errorf("time range has %d steps but %d values were given", len(times), len(in.Values))
+	}
+
+	return times, nil
+}
+
+// timeRange returns every step from start up to and including end
+func timeRange(start time.Time, end time.Time, step time.Duration) ([]time.Time, error) {
+	if end.Before(start) {
+		return nil, errors.New("end_time is before start_time")
+	}
+	if step <= 0 {
+		return nil, errors.New("a time range needs a positive step")
+	}
+	if end.Sub(start)/step >= maxTimeSteps {
+		return nil, fmt.Errorf("time range covers more than %d steps", maxTimeSteps)
+	}
+
+	var times []time.Time
+	for t := start; !t.After(end); t = t.Add(step) {
+		times = append(times, t)
+	}
+
+	return times, nil
+}
+
+// requestFingerprint identifies what a request asks for, ignoring the ids the
+// client attached to it
+func requestFingerprint(in *pb.ValidateOneRequest) (string, error) {
+	stripped := proto.Clone(in).(*pb.ValidateOneRequest)
+	stripped.RequestId = ""
+	stripped.IdempotencyKey = ""
+
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(stripped)
+	return string(b), err
+}
@@ -0,0 +1,104 @@
+package coordinator
+
+import (
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimeRange(t *testing.T) {
+	noon := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		start time.Time
+		end   time.Time
+		step  time.Duration
+		// nil if the range is invalid
+		times []time.Time
+	}{
+		{"single step", noon, noon, time.Hour, []time.Time{noon}},
+		{"end on a step", noon, noon.Add(2 * time.Hour), time.Hour, []time.Time{noon, noon.Add(time.Hour), noon.Add(2 * time.Hour)}},
+		{"end between steps", noon, noon.Add(90 * time.Minute), time.Hour, []time.Time{noon, noon.Add(time.Hour)}},
+		{"inverted", noon, noon.Add(-time.Hour), time.Hour, nil},
+		{"zero step", noon, noon.Add(time.Hour), 0, nil},
+		{"negative step", noon, noon.Add(time.Hour), -time.Hour, nil},
+		{"one step too many", noon, noon.Add(maxTimeSteps * time.Minute), time.Minute, nil},
+	}
+
+	for _, c := range cases {
+		times, err := timeRange(c.start, c.end, c.step)
+		if c.times == nil {
+			if err == nil {
+				t.Errorf("%s: got %d times, expected an error", c.name, len(times))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !reflect.DeepEqual(times, c.times) {
+			t.Errorf("%s: got times %v, expected %v", c.name, times, c.times)
+		}
+	}
+
+	// exactly maxTimeSteps steps is allowed
+	times, err := timeRange(noon, noon.Add((maxTimeSteps-1)*time.Minute), time.Minute)
+	if err != nil || len(times) != maxTimeSteps {
+		t.Errorf("got %d times and error %v for %d steps, expected them all", len(times), err, maxTimeSteps)
+	}
+}
+
+func TestRequestTimes(t *testing.T) {
+	noon := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name string
+		in   *pb.ValidateOneRequest
+		// nil if the request is invalid
+		times []time.Time
+	}{
+		{"no time", &pb.ValidateOneRequest{}, []time.Time{{}}},
+		{"start only", &pb.ValidateOneRequest{StartTime: timestamppb.New(noon)}, []time.Time{noon}},
+		{
+			"range",
+			&pb.ValidateOneRequest{StartTime: timestamppb.New(noon), EndTime: timestamppb.New(noon.Add(time.Hour)), Step: durationpb.New(30 * time.Minute)},
+			[]time.Time{noon, noon.Add(30 * time.Minute), noon.Add(time.Hour)},
+		},
+		{
+			"range with a value per step",
+			&pb.ValidateOneRequest{StartTime: timestamppb.New(noon), EndTime: timestamppb.New(noon.Add(time.Hour)), Step: durationpb.New(time.Hour), Values: []float64{1, 2}},
+			[]time.Time{noon, noon.Add(time.Hour)},
+		},
+		{
+			"range with too few values",
+			&pb.ValidateOneRequest{StartTime: timestamppb.New(noon), EndTime: timestamppb.New(noon.Add(time.Hour)), Step: durationpb.New(time.Hour), Values: []float64{1}},
+			nil,
+		},
+		{
+			"inverted range",
+			&pb.ValidateOneRequest{StartTime: timestamppb.New(noon), EndTime: timestamppb.New(noon.Add(-time.Hour)), Step: durationpb.New(time.Hour)},
+			nil,
+		},
+		{"range without a step", &pb.ValidateOneRequest{StartTime: timestamppb.New(noon), EndTime: timestamppb.New(noon.Add(time.Hour))}, nil},
+		{"end without a start", &pb.ValidateOneRequest{EndTime: timestamppb.New(noon)}, nil},
+		{"step without a start", &pb.ValidateOneRequest{Step: durationpb.New(time.Hour)}, nil},
+	}
+
+	for _, c := range cases {
+		times, err := requestTimes(c.in)
+		if c.times == nil {
+			if err == nil {
+				t.Errorf("%s: got %d times, expected an error", c.name, len(times))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		} else if !reflect.DeepEqual(times, c.times) {
+			t.Errorf("%s: got times %v, expected %v", c.name, times, c.times)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package coordinator
+
+import (
+	"errors"
+	pb "github.com/metno/rove/proto"
+	"sync"
+)
+
+var errSenderClosed = errors.New("stream sender closed")
+
+// queuedSender sends responses on a stream from its own goroutine, through a
+// buffered queue. That way a slow client doesn't hold up scheduling more
+// tests until the queue fills, after which Send blocks. It also serialises
+// sends, since grpc doesn't allow Send to be called from more than one
+// goroutine at once.
+type queuedSender struct {
+	srv   pb.Coordinator_ValidateOneServer
+	queue chan *pb.ValidateResponse
+	// closed if a send fails, after err is set
+	failed chan struct{}
+	// closed once the sending goroutine has exited, after err is set
+	done      chan struct{}
+	err       error
+	closeOnce sync.Once
+}
+
+func newQueuedSender(srv pb.Coordinator_ValidateOneServer, size int) *queuedSender {
+	sender := &queuedSender{
+		srv:    srv,
+		queue:  make(chan *pb.ValidateResponse, size),
+		failed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go sender.run()
+
+	return sender
+}
+
+func (sender *queuedSender) run() {
+	defer close(sender.done)
+
+	for resp := range sender.queue {
+		// nil is queued by Close, once everything before it is sent
+		if resp == nil {
+			return
+		}
+
+		if err := sender.srv.Send(resp); err != nil {
+			sender.err = err
+			close(sender.failed)
+			return
+		}
+	}
+}
+
+// Send queues resp to be sent, blocking if the queue is full. It returns an
+// error if an earlier send failed, or if the sender is closed.
+func (sender *queuedSender) Send(resp *pb.ValidateResponse) error {
+	// checked first, since select picks at random between ready cases, and
+	// the queue may well have room after a failure
+	select {
+	case <-sender.failed:
+		return sender.err
+	case <-sender.done:
+		return sender.closedErr()
+	default:
+	}
+
+	select {
+	case sender.queue <- resp:
+		return nil
+	case <-sender.failed:
+		return sender.err
+	case <-sender.done:
+		return sender.closedErr()
+	}
+}
+
+// closedErr is what Send returns once the sending goroutine has exited: the
+// error it failed with, if it did
+func (sender *queuedSender) closedErr() error {
+	if sender.err != nil {
+		return sender.err
+	}
+	return errSenderClosed
+}
+
+// Close waits for everything queued to be sent, and returns the error from
+// the first failed send if there was one. It must be called before the
+// handler using the sender returns, and is safe to call more than once.
+func (sender *queuedSender) Close() error {
+	sender.closeOnce.Do(func() {
+		select {
+		case sender.queue <- nil:
+		case <-sender.failed:
+		}
+	})
+	<-sender.done
+
+	return sender.err
+}
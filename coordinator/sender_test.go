@@ -0,0 +1,85 @@
+package coordinator
+
+import (
+	"errors"
+	pb "github.com/metno/rove/proto"
+	"testing"
+)
+
+// failingStream records what is sent on it like recordingStream, until the
+// send numbered failAt, which fails along with every send after it
+type failingStream struct {
+	recordingStream
+	failAt int
+}
+
+var errStreamBroken = errors.New("stream broken")
+
+func (stream *failingStream) Send(resp *pb.ValidateResponse) error {
+	if len(stream.sent) >= stream.failAt {
+		return errStreamBroken
+	}
+	return stream.recordingStream.Send(resp)
+}
+
+func TestQueuedSenderKeepsOrder(t *testing.T) {
+	stream := &recordingStream{}
+	// a queue much shorter than the responses, so Send has to wait for it
+	sender := newQueuedSender(stream, 4)
+
+	for i := 0; i < 100; i++ {
+		if err := sender.Send(&pb.ValidateResponse{FlagId: uint32(i)}); err != nil {
+			t.Fatalf("failed to send response %d: %v", i, err)
+		}
+	}
+	if err := sender.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	if len(stream.sent) != 100 {
+		t.Fatalf("sent %d responses, expected 100", len(stream.sent))
+	}
+	for i, resp := range stream.sent {
+		if resp.FlagId != uint32(i) {
+			t.Fatalf("response %d sent in position %d", resp.FlagId, i)
+		}
+	}
+
+	if err := sender.Send(&pb.ValidateResponse{}); err != errSenderClosed {
+		t.Errorf("send after close gave error %v, expected %v", err, errSenderClosed)
+	}
+}
+
+func TestQueuedSenderStreamFailsMidQueue(t *testing.T) {
+	stream := &failingStream{failAt: 3}
+	sender := newQueuedSender(stream, 16)
+
+	// all queued before the failure can stop them, since the queue has room
+	for i := 0; i < 10; i++ {
+		if err := sender.Send(&pb.ValidateResponse{FlagId: uint32(i)}); err != nil && err != errStreamBroken {
+			t.Fatalf("send %d gave error %v, expected none or %v", i, err, errStreamBroken)
+		}
+	}
+
+	if err := sender.Close(); err != errStreamBroken {
+		t.Errorf("close gave error %v, expected %v", err, errStreamBroken)
+	}
+	if len(stream.sent) != 3 {
+		t.Errorf("sent %d responses, expected the 3 before the failure", len(stream.sent))
+	}
+	for i, resp := range stream.sent {
+		if resp.FlagId != uint32(i) {
+			t.Errorf("response %d sent in position %d", resp.FlagId, i)
+		}
+	}
+
+	// the failure sticks, rather than later responses being queued and lost
+	for i := 0; i < 3; i++ {
+		if err := sender.Send(&pb.ValidateResponse{}); err != errStreamBroken {
+			t.Errorf("send after the failure gave error %v, expected %v", err, errStreamBroken)
+		}
+	}
+	if err := sender.Close(); err != errStreamBroken {
+		t.Errorf("second close gave error %v, expected %v", err, errStreamBroken)
+	}
+}
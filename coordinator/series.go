@@ -0,0 +1,292 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// seriesInput is a time series of observations for a series test. Missing
+// observations are NaN.
+type seriesInput struct {
+	requestId string
+	dataId    uint32
+	stationId uint32
+	times     []time.Time
+	values    []float64
+	// form: params[param_name]value
+	params map[string]float64
+}
+
+// param returns the parameter called name, or fallback if it wasn't given
+func (input seriesInput) param(name string, fallback float64) float64 {
+	if value, ok := input.params[name]; ok {
+		return value
+	}
+	return fallback
+}
+
+// seriesTestFunc runs a test over a whole series at once, for tests that
+// compare each observation with the ones around it. It returns a flag for
+// every observation, in order.
+type seriesTestFunc func(ctx context.Context, input seriesInput) ([]pb.Flag, error)
+
+type seriesTest struct {
+	description string
+	run         seriesTestFunc
+}
+
+// series tests, by name. They aren't part of the dag, since each runs on its
+// own over the whole series.
+// form: seriesTests[test_name]test
+var seriesTests = map[string]seriesTest{
+	"step":     {description: "Change from the previous observation is at most max_step (default 10)", run: stepTest},
+	"spike":    {description: "Observation doesn't stand out from both neighbours by more than max_spike (default 5)", run: spikeTest},
+	"flatline": {description: "Observation isn't part of a run of at least max_flatline (default 4) identical values", run: flatlineTest},
+}
+
+// stepTest fails observations that changed too much since the previous one
+func stepTest(ctx context.Context, input seriesInput) ([]pb.Flag, error) {
+	max_step := input.param("max_step", 10)
+
+	flags := make([]pb.Flag, len(input.values))
+	for i, value := range input.values {
+		switch {
+		case math.IsNaN(value):
+			flags[i] = pb.Flag_MISSING
+		case i == 0 || math.IsNaN(input.values[i-1]):
+			flags[i] = pb.Flag_OK
+		case math.Abs(value-input.values[i-1]) > max_step:
+			flags[i] = pb.Flag_FAIL
+		default:
+			flags[i] = pb.Flag_OK
+		}
+	}
+
+	return flags, nil
+}
+
+// spikeTest fails observations that jump away from both their neighbours in
+// the same direction, and come straight back
+func spikeTest(ctx context.Context, input seriesInput) ([]pb.Flag, error) {
+	max_spike := input.param("max_spike", 5)
+
+	flags := make([]pb.Flag, len(input.values))
+	for i, value := range input.values {
+		if math.IsNaN(value) {
+			flags[i] = pb.Flag_MISSING
+			continue
+		}
+		flags[i] = pb.Flag_OK
+
+		// the ends have only one neighbour, so can't be told apart from a step
+		if i == 0 || i == len(input.values)-1 {
+			continue
+		}
+		before := value - input.values[i-1]
+		after := value - input.values[i+1]
+		if math.Abs(before) > max_spike && math.Abs(after) > max_spike && (before > 0) == (after > 0) {
+			flags[i] = pb.Flag_FAIL
+		}
+	}
+
+	return flags, nil
+}
+
+// flatlineTest fails observations in a run of identical values, which is
+// usually a stuck sensor
+func flatlineTest(ctx context.Context, input seriesInput) ([]pb.Flag, error) {
+	max_flatline := int(input.param("max_flatline", 4))
+
+	flags := make([]pb.Flag, len(input.values))
+	for start := 0; start < len(input.values); {
+		end := start + 1
+		for end < len(input.values) && input.values[end] == input.values[start] {
+			end++
+		}
+
+		for i := start; i < end; i++ {
+			switch {
+			case math.IsNaN(input.values[i]):
+				flags[i] = pb.Flag_MISSING
+			case end-start >= max_flatline:
+				flags[i] = pb.Flag_FAIL
+			default:
+				flags[i] = pb.Flag_OK
+			}
+		}
+		start = end
+	}
+
+	return flags, nil
+}
+
+// validateSeriesRequest rejects malformed series requests before any work is
+// done, returning the times the series covers otherwise
+func validateSeriesRequest(in *pb.ValidateSeriesRequest) ([]time.Time, error) {
+	if len(in.Tests) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no tests requested")
+	}
+
+	var unknown []string
+	for _, test := range in.Tests {
+		if _, ok := seriesTests[test]; !ok {
+			unknown = append(unknown, test)
+		}
+	}
+	if len(unknown) > 0 {
+		known := make([]string, 0, len(seriesTests))
+		for test := range seriesTests {
+			known = append(known, test)
+		}
+		sort.Strings(known)
+		return nil, status.Errorf(codes.InvalidArgument, "unknown series tests %v, expected some of %v", unknown, known)
+	}
+
+	if in.StartTime == nil || in.EndTime == nil || in.Step == nil {
+		return nil, status.Error(codes.InvalidArgument, "a series needs a start_time, end_time and step")
+	}
+	times, err := timeRange(in.StartTime.AsTime(), in.EndTime.AsTime(), in.Step.AsDuration())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if len(in.Values) > 0 && len(in.Values) != len(times) {
+		return nil, status.Errorf(codes.InvalidArgument, "time range has %d steps but %d values were given", len(times), len(in.Values))
+	}
+
+	return times, nil
+}
+
+// ValidateSeries runs series tests over a station's observations in a time
+// range. Like ValidateOne, it is limited by --max-concurrent-validations and
+// --max-concurrent-tests-total, can be listed and cancelled, is audited, and
+// its flags are sent to the result sinks.
+func (s *server) ValidateSeries(in *pb.ValidateSeriesRequest, srv pb.Coordinator_ValidateSeriesServer) (err error) {
+	audit := auditEntry{
+		DataId: in.DataId,
+		Tests:  in.Tests,
+		Start:  time.Now(),
+		Flags:  make(map[string]int),
+	}
+	if s.audit != nil {
+		defer func() {
+			audit.End = time.Now()
+			s.audit.write(audit, err)
+		}()
+	}
+
+	times, err := validateSeriesRequest(in)
+	if err != nil {
+		return err
+	}
+
+	request_id := incomingRequestId(srv.Context())
+	if request_id == "" {
+		request_id = newRequestId()
+	}
+	audit.RequestId = request_id
+	if err := srv.SetHeader(metadata.Pairs(requestIdHeader, request_id)); err != nil {
+		log.Printf("failed to send request id header for request %s: %v", request_id, err)
+	}
+
+	ctx, cancel := context.WithCancel(srv.Context())
+	defer cancel()
+
+	total := len(in.Tests) * len(times)
+	done, err := s.startValidation(srv.Context(), &activeValidation{
+		requestId: request_id,
+		cancel:    cancel,
+		dataId:    in.DataId,
+		tests:     in.Tests,
+		start:     audit.Start,
+		total:     total,
+	})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	values := in.Values
+	if len(values) == 0 {
+		if s.data == nil {
+			return status.Error(codes.FailedPrecondition, "no values were given, and there is no data source to fetch them from")
+		}
+
+		values = make([]float64, len(times))
+		for i, t := range times {
+			// a gap in the series is left for the tests to flag MISSING,
+			// rather than failing the whole series
+			observed, err := s.data.Fetch(ctx, in.DataId, in.StationId, t)
+			if err != nil && !errors.Is(err, errNoObservation) {
+				return status.Errorf(codes.Unavailable, "failed to fetch observation for data %d: %v", in.DataId, err)
+			}
+			values[i] = math.NaN()
+			if len(observed) > 0 {
+				values[i] = observed[0]
+			}
+		}
+	}
+
+	input := seriesInput{
+		requestId: request_id,
+		dataId:    in.DataId,
+		stationId: in.StationId,
+		times:     times,
+		values:    values,
+		params:    in.Parameters,
+	}
+
+	completed := 0
+	for test_index, name := range in.Tests {
+		test := seriesTests[name]
+
+		release, err := s.acquireTestSlot(ctx)
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		flags, err := test.run(ctx, input)
+		release()
+		if err == nil && len(flags) != len(times) {
+			err = fmt.Errorf("series test %s gave %d flags for %d observations", name, len(flags), len(times))
+		}
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+
+		for i, t := range times {
+			completed++
+			resp := &pb.ValidateResponse{
+				DataId:      in.DataId,
+				FlagId:      uint32(test_index),
+				Description: test.description,
+				Completed:   uint32(completed),
+				Total:       uint32(total),
+				Time:        timestamppb.New(t),
+			}
+			if err != nil {
+				resp.Flag = pb.Flag_ERROR
+				resp.ErrorMessage = err.Error()
+			} else {
+				resp.Flag = flags[i]
+			}
+
+			if err := srv.Send(resp); err != nil {
+				return err
+			}
+			s.record(request_id, seriesPipeline, name, resp)
+			s.active.progress(request_id, completed)
+			audit.Flags[resp.Flag.String()]++
+		}
+	}
+
+	return srv.Send(&pb.ValidateResponse{DataId: in.DataId, Completed: uint32(completed), Total: uint32(total), Complete: true})
+}
@@ -0,0 +1,105 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+func seriesRequest() *pb.ValidateSeriesRequest {
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &pb.ValidateSeriesRequest{
+		DataId:    7,
+		Tests:     []string{"step"},
+		StartTime: timestamppb.New(start),
+		EndTime:   timestamppb.New(start.Add(2 * time.Hour)),
+		Step:      durationpb.New(time.Hour),
+		Values:    []float64{1, 2, 30},
+	}
+}
+
+func TestValidateSeriesRecordsResults(t *testing.T) {
+	sink := &collectingSink{}
+	s := newTestServer()
+	s.sinks = []ResultSink{sink}
+
+	stream := &recordingStream{}
+	if err := s.ValidateSeries(seriesRequest(), stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.results) != 3 {
+		t.Fatalf("%d results recorded, expected one per time step", len(sink.results))
+	}
+	for _, res := range sink.results {
+		if res.Test != "step" || res.Pipeline != seriesPipeline || res.Resp.DataId != 7 {
+			t.Errorf("result recorded for test %q of pipeline %q and data %d, expected step of %s and 7", res.Test, res.Pipeline, res.Resp.DataId, seriesPipeline)
+		}
+	}
+	if len(s.active.list()) != 0 {
+		t.Error("series validation is still registered after finishing")
+	}
+}
+
+func TestValidateSeriesWaitsForLimiter(t *testing.T) {
+	s := newTestServer()
+	s.limiter = newValidationLimiter(1, 0)
+
+	// another validation is already taking the only slot, with no room to
+	// queue behind it
+	if err := s.limiter.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.ValidateSeries(seriesRequest(), &recordingStream{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("got %v, expected ResourceExhausted", err)
+	}
+}
+
+// brokenSource is a DataSource that can't be reached
+type brokenSource struct{}
+
+func (brokenSource) Fetch(ctx context.Context, data_id uint32, station_id uint32, t time.Time) ([]float64, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestValidateSeriesFetchesGaps(t *testing.T) {
+	in := seriesRequest()
+	in.Values = nil
+	start := in.StartTime.AsTime()
+
+	// nothing observed at the middle step
+	s := newTestServer()
+	s.data = &memorySource{observations: map[string][]float64{
+		memoryKey(7, 0, start):                  {1},
+		memoryKey(7, 0, start.Add(2*time.Hour)): {30},
+	}}
+
+	stream := &recordingStream{}
+	if err := s.ValidateSeries(in, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []pb.Flag{pb.Flag_OK, pb.Flag_MISSING, pb.Flag_OK}
+	if len(stream.sent) != len(expected)+1 {
+		t.Fatalf("sent %d responses, expected %d flags and the completion", len(stream.sent), len(expected))
+	}
+	for i, f := range expected {
+		if stream.sent[i].Flag != f {
+			t.Errorf("step %d got %s, expected %s", i, stream.sent[i].Flag, f)
+		}
+	}
+
+	// a source that isn't there at all is another matter
+	s.data = brokenSource{}
+	if err := s.ValidateSeries(in, &recordingStream{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v from a broken data source, expected UNAVAILABLE", err)
+	}
+}
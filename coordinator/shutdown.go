@@ -0,0 +1,67 @@
+package coordinator
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+)
+
+// handlerTracker keeps count of the handlers running, so shutdown can wait
+// for them before closing the result sinks and audit log they write to. grpc's
+// Stop cancels running handlers, but doesn't wait for them to return.
+type handlerTracker struct {
+	mutex sync.Mutex
+	// set by wait, after which no more handlers start
+	stopping bool
+	running  sync.WaitGroup
+}
+
+// start counts a handler as running, or returns false if the coordinator is
+// shutting down. finish must be called once the handler returns if start
+// succeeded.
+func (tracker *handlerTracker) start() bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if tracker.stopping {
+		return false
+	}
+	tracker.running.Add(1)
+	return true
+}
+
+func (tracker *handlerTracker) finish() {
+	tracker.running.Done()
+}
+
+// wait stops any more handlers from starting, and waits for the running ones
+// to return
+func (tracker *handlerTracker) wait() {
+	tracker.mutex.Lock()
+	tracker.stopping = true
+	tracker.mutex.Unlock()
+
+	tracker.running.Wait()
+}
+
+var errShuttingDown = status.Error(codes.Unavailable, "coordinator is shutting down")
+
+func (tracker *handlerTracker) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !tracker.start() {
+		return nil, errShuttingDown
+	}
+	defer tracker.finish()
+
+	return handler(ctx, req)
+}
+
+func (tracker *handlerTracker) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !tracker.start() {
+		return errShuttingDown
+	}
+	defer tracker.finish()
+
+	return handler(srv, ss)
+}
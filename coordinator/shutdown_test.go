@@ -0,0 +1,62 @@
+package coordinator
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestHandlerTrackerWaitsForHandlers(t *testing.T) {
+	tracker := &handlerTracker{}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler_done := make(chan error)
+	go func() {
+		handler_done <- tracker.streamInterceptor(nil, nil, &grpc.StreamServerInfo{}, func(srv interface{}, ss grpc.ServerStream) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	waited := make(chan struct{})
+	go func() {
+		tracker.wait()
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("wait returned while a handler was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// no new handlers start once shutdown is waiting
+	for stopping := false; !stopping; {
+		tracker.mutex.Lock()
+		stopping = tracker.stopping
+		tracker.mutex.Unlock()
+	}
+	_, err := tracker.unaryInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+		t.Error("handler started during shutdown")
+		return nil, nil
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("call during shutdown gave error %v, expected UNAVAILABLE", err)
+	}
+
+	close(release)
+	if err := <-handler_done; err != nil {
+		t.Errorf("handler gave error %v", err)
+	}
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait didn't return after the handler finished")
+	}
+}
@@ -0,0 +1,56 @@
+package coordinator
+
+import (
+	pb "github.com/metno/rove/proto"
+	"time"
+)
+
+// Result is a single flag produced by a validation, along with the context
+// needed to store it
+type Result struct {
+	RequestId string
+	// the pipeline the test was taken from, empty for the default pipeline.
+	// series and spatial tests aren't part of one, so are recorded under
+	// seriesPipeline and spatialPipeline instead
+	Pipeline string
+	// the name of the test that produced the flag, so it can be told apart
+	// from the same flag id in another pipeline, or after a reload
+	Test string
+	// when the result was produced
+	Time time.Time
+	// the station and time of the observation the flag is for, taken from
+	// Resp. ObsTime is zero if the request didn't give a time
+	StationId uint32
+	ObsTime   time.Time
+	Resp      *pb.ValidateResponse
+}
+
+// the pipeline names series and spatial results are recorded under, so they
+// can't be mistaken for results of a test of the same name in the default
+// pipeline. Pipelines can't be given these names.
+const (
+	seriesPipeline  = "series"
+	spatialPipeline = "spatial"
+)
+
+// ResultSink is somewhere validation results are sent besides the client's
+// stream. Write is called from the scheduling loop, so implementations must
+// not block on it for long.
+type ResultSink interface {
+	Write(res Result)
+	// Close flushes any queued results and releases the sink's resources
+	Close() error
+}
+
+// record passes a result of the test called test_name, from the pipeline
+// called pipeline_name, on to every configured sink
+func (s *server) record(request_id string, pipeline_name string, test_name string, resp *pb.ValidateResponse) {
+	res := Result{RequestId: request_id, Pipeline: pipeline_name, Test: test_name, Time: time.Now(), StationId: resp.StationId, Resp: resp}
+	if resp.Time != nil {
+		res.ObsTime = resp.Time.AsTime()
+	}
+
+	for _, sink := range s.sinks {
+		sink.Write(res)
+	}
+}
@@ -0,0 +1,331 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// spatialInput is the observations of many stations at a single time, for a
+// spatial test
+type spatialInput struct {
+	requestId    string
+	time         time.Time
+	observations []*pb.StationObservation
+	// the indices of the observations to flag. the rest are only neighbours
+	selected []int
+	// form: params[param_name]value
+	params map[string]float64
+}
+
+// param returns the parameter called name, or fallback if it wasn't given
+func (input spatialInput) param(name string, fallback float64) float64 {
+	if value, ok := input.params[name]; ok {
+		return value
+	}
+	return fallback
+}
+
+// spatialTestFunc runs a test over a set of stations at once, for tests that
+// compare each observation with its neighbours. It returns a flag for every
+// selected observation, in the order of input.selected.
+type spatialTestFunc func(ctx context.Context, input spatialInput) ([]pb.Flag, error)
+
+type spatialTest struct {
+	description string
+	run         spatialTestFunc
+}
+
+// spatial tests, by name. Like series tests they aren't part of the dag.
+// form: spatialTests[test_name]test
+var spatialTests = map[string]spatialTest{
+	"buddy": {description: "Observation is within max_difference (default 5) of the median of the stations within radius_km (default 50), if there are at least min_buddies (default 3)", run: buddyTest},
+}
+
+// buddyTest fails observations that differ too much from the median of their
+// neighbours. The median rather than the mean, so a single bad neighbour
+// doesn't get the good observations around it failed too. Observations with
+// too few neighbours to tell get MISSING, as do missing observations, which
+// are NaN.
+func buddyTest(ctx context.Context, input spatialInput) ([]pb.Flag, error) {
+	radius_km := input.param("radius_km", 50)
+	min_buddies := int(input.param("min_buddies", 3))
+	max_difference := input.param("max_difference", 5)
+
+	flags := make([]pb.Flag, len(input.selected))
+	for i, index := range input.selected {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		observation := input.observations[index]
+
+		var buddies []float64
+		for other_index, other := range input.observations {
+			if other_index == index || math.IsNaN(other.Value) {
+				continue
+			}
+			if distanceKm(observation.Latitude, observation.Longitude, other.Latitude, other.Longitude) <= radius_km {
+				buddies = append(buddies, other.Value)
+			}
+		}
+
+		switch {
+		case math.IsNaN(observation.Value):
+			flags[i] = pb.Flag_MISSING
+		case len(buddies) == 0 || len(buddies) < min_buddies:
+			flags[i] = pb.Flag_MISSING
+		case math.Abs(observation.Value-median(buddies)) > max_difference:
+			flags[i] = pb.Flag_FAIL
+		default:
+			flags[i] = pb.Flag_OK
+		}
+	}
+
+	return flags, nil
+}
+
+// median returns the median of values, which must not be empty. values is
+// sorted in place.
+func median(values []float64) float64 {
+	sort.Float64s(values)
+
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// distanceKm is the great circle distance between two points, in km
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earth_radius_km = 6371
+
+	to_radians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	d_lat := to_radians(lat2 - lat1)
+	d_lon := to_radians(lon2 - lon1)
+
+	a := math.Sin(d_lat/2)*math.Sin(d_lat/2) +
+		math.Cos(to_radians(lat1))*math.Cos(to_radians(lat2))*math.Sin(d_lon/2)*math.Sin(d_lon/2)
+	return 2 * earth_radius_km * math.Asin(math.Sqrt(a))
+}
+
+// inPolygon reports whether the point is inside the polygon, by counting how
+// many of its edges a ray from the point crosses. Latitude and longitude are
+// treated as plane coordinates, which is close enough for areas that don't
+// cross the antimeridian or a pole.
+func inPolygon(latitude, longitude float64, vertices []*pb.Point) bool {
+	inside := false
+	for i, j := 0, len(vertices)-1; i < len(vertices); j, i = i, i+1 {
+		a, b := vertices[i], vertices[j]
+		if (a.Latitude > latitude) != (b.Latitude > latitude) &&
+			longitude < (b.Longitude-a.Longitude)*(latitude-a.Latitude)/(b.Latitude-a.Latitude)+a.Longitude {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// selectObservations returns the indices of the observations inside the
+// request's selection, or of all of them if it has none
+func selectObservations(in *pb.ValidateSpatialRequest) []int {
+	var selected []int
+	for index, observation := range in.Observations {
+		switch selection := in.Selection.(type) {
+		case *pb.ValidateSpatialRequest_BoundingBox:
+			box := selection.BoundingBox
+			if observation.Latitude < box.MinLatitude || observation.Latitude > box.MaxLatitude ||
+				observation.Longitude < box.MinLongitude || observation.Longitude > box.MaxLongitude {
+				continue
+			}
+		case *pb.ValidateSpatialRequest_Polygon:
+			if !inPolygon(observation.Latitude, observation.Longitude, selection.Polygon.Vertices) {
+				continue
+			}
+		}
+		selected = append(selected, index)
+	}
+
+	return selected
+}
+
+// validateSpatialRequest rejects malformed spatial requests before any work is
+// done
+func validateSpatialRequest(in *pb.ValidateSpatialRequest) error {
+	if len(in.Tests) == 0 {
+		return status.Error(codes.InvalidArgument, "no tests requested")
+	}
+
+	var unknown []string
+	for _, test := range in.Tests {
+		if _, ok := spatialTests[test]; !ok {
+			unknown = append(unknown, test)
+		}
+	}
+	if len(unknown) > 0 {
+		known := make([]string, 0, len(spatialTests))
+		for test := range spatialTests {
+			known = append(known, test)
+		}
+		sort.Strings(known)
+		return status.Errorf(codes.InvalidArgument, "unknown spatial tests %v, expected some of %v", unknown, known)
+	}
+
+	if in.Time == nil {
+		return status.Error(codes.InvalidArgument, "no time given")
+	}
+	if len(in.Observations) == 0 {
+		return status.Error(codes.InvalidArgument, "no observations given")
+	}
+	if polygon, ok := in.Selection.(*pb.ValidateSpatialRequest_Polygon); ok && len(polygon.Polygon.GetVertices()) < 3 {
+		return status.Error(codes.InvalidArgument, "a polygon needs at least 3 vertices")
+	}
+
+	return nil
+}
+
+// fetchObservations returns a copy of observations with each station's value
+// of data_id at t fetched from s.data, NaN if it has none
+func (s *server) fetchObservations(ctx context.Context, data_id uint32, t time.Time, observations []*pb.StationObservation) ([]*pb.StationObservation, error) {
+	if s.data == nil {
+		return nil, status.Error(codes.FailedPrecondition, "fetch_values is set, but there is no data source to fetch them from")
+	}
+
+	fetched := make([]*pb.StationObservation, len(observations))
+	for i, observation := range observations {
+		// a station with nothing observed is flagged MISSING by the tests,
+		// like one the client sent NaN for
+		observed, err := s.data.Fetch(ctx, data_id, observation.StationId, t)
+		if err != nil && !errors.Is(err, errNoObservation) {
+			return nil, status.Errorf(codes.Unavailable, "failed to fetch observation for data %d at station %d: %v", data_id, observation.StationId, err)
+		}
+
+		fetched[i] = &pb.StationObservation{
+			StationId: observation.StationId,
+			Latitude:  observation.Latitude,
+			Longitude: observation.Longitude,
+			Value:     math.NaN(),
+		}
+		if len(observed) > 0 {
+			fetched[i].Value = observed[0]
+		}
+	}
+
+	return fetched, nil
+}
+
+// ValidateSpatial runs spatial tests over the observations of many stations.
+// It goes through the same limits, registry, audit log and result sinks as
+// ValidateSeries.
+func (s *server) ValidateSpatial(in *pb.ValidateSpatialRequest, srv pb.Coordinator_ValidateSpatialServer) (err error) {
+	audit := auditEntry{
+		DataId: in.DataId,
+		Tests:  in.Tests,
+		Start:  time.Now(),
+		Flags:  make(map[string]int),
+	}
+	if s.audit != nil {
+		defer func() {
+			audit.End = time.Now()
+			s.audit.write(audit, err)
+		}()
+	}
+
+	if err := validateSpatialRequest(in); err != nil {
+		return err
+	}
+
+	request_id := incomingRequestId(srv.Context())
+	if request_id == "" {
+		request_id = newRequestId()
+	}
+	audit.RequestId = request_id
+	if err := srv.SetHeader(metadata.Pairs(requestIdHeader, request_id)); err != nil {
+		log.Printf("failed to send request id header for request %s: %v", request_id, err)
+	}
+
+	ctx, cancel := context.WithCancel(srv.Context())
+	defer cancel()
+
+	input := spatialInput{
+		requestId:    request_id,
+		time:         in.Time.AsTime(),
+		observations: in.Observations,
+		selected:     selectObservations(in),
+		params:       in.Parameters,
+	}
+
+	total := len(in.Tests) * len(input.selected)
+	done, err := s.startValidation(srv.Context(), &activeValidation{
+		requestId: request_id,
+		cancel:    cancel,
+		dataId:    in.DataId,
+		tests:     in.Tests,
+		start:     audit.Start,
+		total:     total,
+	})
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if in.FetchValues {
+		input.observations, err = s.fetchObservations(ctx, in.DataId, input.time, in.Observations)
+		if err != nil {
+			return err
+		}
+	}
+
+	completed := 0
+	for test_index, name := range in.Tests {
+		test := spatialTests[name]
+
+		release, err := s.acquireTestSlot(ctx)
+		if err != nil {
+			return status.FromContextError(err).Err()
+		}
+		flags, err := test.run(ctx, input)
+		release()
+		if err == nil && len(flags) != len(input.selected) {
+			err = fmt.Errorf("spatial test %s gave %d flags for %d observations", name, len(flags), len(input.selected))
+		}
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+
+		for i, index := range input.selected {
+			completed++
+			resp := &pb.ValidateResponse{
+				DataId:      in.DataId,
+				StationId:   in.Observations[index].StationId,
+				FlagId:      uint32(test_index),
+				Description: test.description,
+				Completed:   uint32(completed),
+				Total:       uint32(total),
+				Time:        in.Time,
+			}
+			if err != nil {
+				resp.Flag = pb.Flag_ERROR
+				resp.ErrorMessage = err.Error()
+			} else {
+				resp.Flag = flags[i]
+			}
+
+			if err := srv.Send(resp); err != nil {
+				return err
+			}
+			s.record(request_id, spatialPipeline, name, resp)
+			s.active.progress(request_id, completed)
+			audit.Flags[resp.Flag.String()]++
+		}
+	}
+
+	return srv.Send(&pb.ValidateResponse{DataId: in.DataId, Completed: uint32(completed), Total: uint32(total), Complete: true})
+}
@@ -0,0 +1,73 @@
+package coordinator
+
+import (
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+// spatialRequest asks for the buddy test over five stations close together,
+// with values fetched for data 9
+func spatialRequest(t time.Time) *pb.ValidateSpatialRequest {
+	return &pb.ValidateSpatialRequest{
+		Tests: []string{"buddy"},
+		Time:  timestamppb.New(t),
+		Observations: []*pb.StationObservation{
+			{StationId: 1, Latitude: 60, Longitude: 10},
+			{StationId: 2, Latitude: 60.1, Longitude: 10},
+			{StationId: 3, Latitude: 60, Longitude: 10.1},
+			{StationId: 4, Latitude: 60.1, Longitude: 10.1},
+			{StationId: 5, Latitude: 60.05, Longitude: 10.05},
+		},
+		DataId:      9,
+		FetchValues: true,
+	}
+}
+
+func TestValidateSpatialFetchesValues(t *testing.T) {
+	noon := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	sink := &collectingSink{}
+	s := newTestServer()
+	s.sinks = []ResultSink{sink}
+	// station 4 stands out from its buddies, and station 5 has no observation
+	s.data = &memorySource{observations: map[string][]float64{
+		memoryKey(9, 1, noon): {5},
+		memoryKey(9, 2, noon): {6},
+		memoryKey(9, 3, noon): {4},
+		memoryKey(9, 4, noon): {20},
+	}}
+
+	stream := &recordingStream{}
+	if err := s.ValidateSpatial(spatialRequest(noon), stream); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[uint32]pb.Flag{1: pb.Flag_OK, 2: pb.Flag_OK, 3: pb.Flag_OK, 4: pb.Flag_FAIL, 5: pb.Flag_MISSING}
+	for _, resp := range stream.sent[:len(stream.sent)-1] {
+		if resp.Flag != expected[resp.StationId] {
+			t.Errorf("station %d got %s, expected %s", resp.StationId, resp.Flag, expected[resp.StationId])
+		}
+		if resp.DataId != 9 {
+			t.Errorf("station %d's flag has data id %d, expected 9", resp.StationId, resp.DataId)
+		}
+	}
+	if len(sink.results) != len(expected) {
+		t.Errorf("%d results recorded, expected one per station", len(sink.results))
+	}
+	for _, res := range sink.results {
+		if res.Pipeline != spatialPipeline {
+			t.Errorf("station %d's result recorded for pipeline %q, expected %s", res.StationId, res.Pipeline, spatialPipeline)
+		}
+	}
+
+	// a station without an observation is one thing, a source that can't be
+	// reached is another
+	s.data = brokenSource{}
+	if err := s.ValidateSpatial(spatialRequest(noon), &recordingStream{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("got %v from a broken data source, expected UNAVAILABLE", err)
+	}
+}
@@ -0,0 +1,83 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// the furthest a name can be from a known test for it to be suggested
+const maxSuggestionDistance = 2
+
+// suggestTests returns the known test names closest to name, within
+// maxSuggestionDistance edits, in alphabetical order
+func suggestTests(name string, index_lookup map[string]int) []string {
+	best_distance := maxSuggestionDistance + 1
+	var suggestions []string
+
+	for test := range index_lookup {
+		distance := levenshtein(name, test)
+		if distance > maxSuggestionDistance {
+			continue
+		}
+		if distance < best_distance {
+			best_distance = distance
+			suggestions = []string{test}
+		} else if distance == best_distance {
+			suggestions = append(suggestions, test)
+		}
+	}
+	sort.Strings(suggestions)
+
+	return suggestions
+}
+
+// didYouMean formats suggestions as an addition to an error message, or
+// returns "" if there are none
+func didYouMean(suggestions []string) string {
+	if len(suggestions) == 0 {
+		return ""
+	}
+
+	quoted := make([]string, len(suggestions))
+	for i, suggestion := range suggestions {
+		quoted[i] = fmt.Sprintf("%q", suggestion)
+	}
+
+	return fmt.Sprintf("; did you mean %s?", strings.Join(quoted, " or "))
+}
+
+// levenshtein returns the edit distance between a and b
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
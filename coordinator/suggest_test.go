@@ -0,0 +1,56 @@
+package coordinator
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		distance int
+	}{
+		{"", "", 0},
+		{"test1", "test1", 0},
+		{"", "test1", 5},
+		{"test_1", "test1", 1},
+		{"test1", "test2", 1},
+		{"tset1", "test1", 2},
+		{"kitten", "sitting", 3},
+		// distances are counted in runes, not bytes
+		{"snø", "sno", 1},
+	}
+
+	for _, c := range cases {
+		if distance := levenshtein(c.a, c.b); distance != c.distance {
+			t.Errorf("distance from %q to %q is %d, expected %d", c.a, c.b, distance, c.distance)
+		}
+		if distance := levenshtein(c.b, c.a); distance != c.distance {
+			t.Errorf("distance from %q to %q is %d, expected %d", c.b, c.a, distance, c.distance)
+		}
+	}
+}
+
+func TestSuggestTests(t *testing.T) {
+	// form: index_lookup[test_name]index
+	index_lookup := map[string]int{"test1": 0, "test2": 1, "test3": 2, "test4": 3, "test5": 4, "test6": 5}
+
+	cases := []struct {
+		name        string
+		suggestions []string
+	}{
+		{"test_1", []string{"test1"}},
+		{"tset1", []string{"test1"}},
+		// every test is one edit away, so they are all suggested
+		{"test", []string{"test1", "test2", "test3", "test4", "test5", "test6"}},
+		// nothing closer than maxSuggestionDistance
+		{"tst_10", nil},
+		{"spike", nil},
+	}
+
+	for _, c := range cases {
+		if suggestions := suggestTests(c.name, index_lookup); !reflect.DeepEqual(suggestions, c.suggestions) {
+			t.Errorf("suggestions for %q are %v, expected %v", c.name, suggestions, c.suggestions)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package coordinator
+
+import (
+	"context"
+	pb "github.com/metno/rove/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// collectingStream stands in for a ValidateOne stream, collecting the
+// responses instead of sending them, so ValidateOneSync can reuse ValidateOne.
+// Only Send, SetHeader and Context are implemented.
+type collectingStream struct {
+	grpc.ServerStream
+	ctx       context.Context
+	responses []*pb.ValidateResponse
+}
+
+func (stream *collectingStream) Send(resp *pb.ValidateResponse) error {
+	// heartbeats are only there to keep a stream alive
+	if !resp.Heartbeat {
+		stream.responses = append(stream.responses, resp)
+	}
+	return nil
+}
+
+// SetHeader passes header metadata on as the unary call's header
+func (stream *collectingStream) SetHeader(md metadata.MD) error {
+	return grpc.SetHeader(stream.ctx, md)
+}
+
+func (stream *collectingStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (s *server) ValidateOneSync(ctx context.Context, in *pb.ValidateOneRequest) (*pb.ValidateSyncResponse, error) {
+	stream := &collectingStream{ctx: ctx}
+	if err := s.ValidateOne(in, stream); err != nil {
+		return nil, err
+	}
+
+	return &pb.ValidateSyncResponse{Flags: stream.responses}, nil
+}
@@ -0,0 +1,133 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"github.com/intarga/dagrid"
+	pb "github.com/metno/rove/proto"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"time"
+)
+
+// testFunc runs a single test on input. It should give up and return ctx's
+// error if ctx is cancelled.
+type testFunc func(ctx context.Context, input testInput) (pb.Flag, error)
+
+// implementations of the tests, by name
+// form: testFuncs[test_name]implementation
+var testFuncs = make(map[string]testFunc)
+
+// registerTest makes fn the implementation of the test called name. It is
+// meant to be called from init, so registering a name twice panics.
+func registerTest(name string, fn testFunc) {
+	if _, ok := testFuncs[name]; ok {
+		panic(fmt.Sprintf("test %s registered twice", name))
+	}
+	testFuncs[name] = fn
+}
+
+func init() {
+	// TODO: replace with real tests
+	for _, name := range []string{"test1", "test2", "test3", "test4", "test5", "test6"} {
+		registerTest(name, newPlaceholderTest(name))
+	}
+}
+
+// placeholderSeed seeds the placeholder tests' random run times. Runs with the
+// same seed, on the same input, take the same time.
+var placeholderSeed = time.Now().UnixNano()
+
+// newPlaceholderTest returns a test that takes a random time to pass. Every
+// run gets its own source of randomness, seeded from placeholderSeed, the test
+// name and the input, so runs don't share random state between goroutines.
+func newPlaceholderTest(name string) testFunc {
+	return func(ctx context.Context, input testInput) (pb.Flag, error) {
+		hash := fnv.New64a()
+		fmt.Fprintf(hash, "%s %d %d", name, input.dataId, input.time.UnixNano())
+		rng := rand.New(rand.NewSource(placeholderSeed ^ int64(hash.Sum64())))
+
+		select {
+		case <-time.After(time.Duration(500+rng.Intn(500)) * time.Millisecond):
+		case <-ctx.Done():
+			return pb.Flag_UNSPECIFIED, ctx.Err()
+		}
+
+		return pb.Flag_OK, nil
+	}
+}
+
+// runTestFunc is what runSubDag runs each test with. Only tests replace it,
+// to simulate results that arrive late or more than once.
+var runTestFunc = runTest
+
+// runTest runs the registered implementation of test_name on input, and sends
+// its result on ch. Tests with no implementation are skipped. Nothing is sent
+// if ctx is cancelled first. If timeout is set and the test takes longer, it
+// is cancelled and gives an error.
+func runTest(ctx context.Context, test_name string, input testInput, timeout time.Duration, ch chan<- testResult) {
+	fn, ok := testFuncs[test_name]
+	if !ok {
+		ch <- testResult{name: test_name, err: fmt.Errorf("test %s is not implemented", test_name), skipped: true}
+		return
+	}
+
+	start := time.Now()
+
+	// tests run on their own goroutine, out of reach of the grpc recovery
+	// interceptors, so a panicking test would take down the coordinator
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("panic in test %s: %v\n%s", test_name, r, debug.Stack())
+			ch <- testResult{
+				name:     test_name,
+				err:      fmt.Errorf("test %s panicked: %v", test_name, r),
+				start:    start,
+				duration: time.Since(start),
+			}
+		}
+	}()
+
+	test_ctx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		test_ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	flag, err := fn(test_ctx, input)
+	duration := time.Since(start)
+	if ctx.Err() != nil {
+		return
+	}
+	if test_ctx.Err() == context.DeadlineExceeded {
+		log.Printf("test %s timed out after %v", test_name, timeout)
+		flag, err = pb.Flag_UNSPECIFIED, fmt.Errorf("test %s timed out after %v", test_name, timeout)
+	}
+
+	// a buggy test returning neither a flag nor an error would otherwise be
+	// sent on as an unset flag
+	if err == nil && flag == pb.Flag_UNSPECIFIED {
+		log.Printf("test %s returned no flag and no error", test_name)
+		err = fmt.Errorf("test %s returned no flag", test_name)
+	}
+
+	ch <- testResult{name: test_name, flag: flag, err: err, start: start, duration: duration}
+}
+
+// unimplementedTests returns the sorted names of the tests in dag that have
+// no registered implementation
+func unimplementedTests(dag *dagrid.Dag) []string {
+	var missing []string
+	for name := range dag.IndexLookup {
+		if _, ok := testFuncs[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing
+}
@@ -0,0 +1,112 @@
+package coordinator
+
+import (
+	"fmt"
+	"github.com/metno/rove/internal/rovecore"
+	pb "github.com/metno/rove/proto"
+)
+
+// verdictPolicy reduces all the flags produced by a validation to a single
+// overall verdict for the data
+type verdictPolicy func(flags []*pb.ValidateResponse) pb.Flag
+
+var verdictPolicies = map[string]verdictPolicy{
+	"worst-of": worstOfVerdict,
+	"any-fail": anyFailVerdict,
+}
+
+// newVerdictPolicy looks up a policy by name. fail_weight is the threshold
+// for the weighted policy, and ignored by the others.
+func newVerdictPolicy(name string, fail_weight int) (verdictPolicy, error) {
+	if name == "weighted" {
+		if fail_weight <= 0 {
+			return nil, fmt.Errorf("verdict fail weight must be positive, got %d", fail_weight)
+		}
+		return newWeightedVerdict(fail_weight), nil
+	}
+
+	policy, ok := verdictPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown verdict policy %q, expected worst-of, any-fail or weighted", name)
+	}
+
+	return policy, nil
+}
+
+// failed reports whether a flag means the data didn't pass the test
+func failed(flag pb.Flag) bool {
+	return flag == pb.Flag_FAIL || flag == pb.Flag_ERROR
+}
+
+// worstOfVerdict is the worst flag produced
+func worstOfVerdict(flags []*pb.ValidateResponse) pb.Flag {
+	worst := pb.Flag_OK
+	for _, resp := range flags {
+		if rovecore.FlagRank(resp.Flag) > rovecore.FlagRank(worst) {
+			worst = resp.Flag
+		}
+	}
+
+	return worst
+}
+
+// anyFailVerdict is FAIL if any test failed, and OK otherwise
+func anyFailVerdict(flags []*pb.ValidateResponse) pb.Flag {
+	for _, resp := range flags {
+		if failed(resp.Flag) {
+			return pb.Flag_FAIL
+		}
+	}
+
+	return pb.Flag_OK
+}
+
+// severityWeight is how much a flag from a test of the given severity counts
+// towards the weighted verdict. Failures count double warnings, so a single
+// HIGH failure outweighs any two LOW or MEDIUM warnings.
+func severityWeight(flag pb.Flag, severity pb.Severity) int {
+	var weight int
+	switch severity {
+	case pb.Severity_HIGH:
+		weight = 4
+	case pb.Severity_MEDIUM:
+		weight = 2
+	default:
+		// every test has a severity, LOW unless its pipeline says otherwise,
+		// so an unspecified one is a bug. it counts the least rather than not
+		// at all, so failures still show up in the verdict
+		weight = 1
+	}
+
+	switch {
+	case failed(flag):
+		return 2 * weight
+	case flag == pb.Flag_WARN:
+		return weight
+	default:
+		return 0
+	}
+}
+
+// newWeightedVerdict returns a policy weighing failures and warnings by the
+// severity of their tests. The verdict is FAIL once the weights add up to
+// fail_weight, WARN if anything failed or warned short of that, and OK
+// otherwise. The default fail_weight of 8 fails data on one HIGH or two
+// MEDIUM severity failures.
+func newWeightedVerdict(fail_weight int) verdictPolicy {
+	return func(flags []*pb.ValidateResponse) pb.Flag {
+		weight := 0
+		for _, resp := range flags {
+			weight += severityWeight(resp.Flag, resp.Severity)
+		}
+
+		switch {
+		case weight >= fail_weight:
+			return pb.Flag_FAIL
+		case weight > 0:
+			return pb.Flag_WARN
+		default:
+			return pb.Flag_OK
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package coordinator
+
+import (
+	pb "github.com/metno/rove/proto"
+	"testing"
+)
+
+func TestSeverityWeight(t *testing.T) {
+	cases := []struct {
+		flag     pb.Flag
+		severity pb.Severity
+		weight   int
+	}{
+		{pb.Flag_FAIL, pb.Severity_HIGH, 8},
+		{pb.Flag_ERROR, pb.Severity_MEDIUM, 4},
+		{pb.Flag_FAIL, pb.Severity_LOW, 2},
+		{pb.Flag_WARN, pb.Severity_HIGH, 4},
+		{pb.Flag_WARN, pb.Severity_LOW, 1},
+		{pb.Flag_OK, pb.Severity_HIGH, 0},
+		// unset severities count as LOW
+		{pb.Flag_FAIL, pb.Severity_SEVERITY_UNSPECIFIED, 2},
+		{pb.Flag_WARN, pb.Severity_SEVERITY_UNSPECIFIED, 1},
+	}
+
+	for _, c := range cases {
+		if weight := severityWeight(c.flag, c.severity); weight != c.weight {
+			t.Errorf("%s from a %s test weighs %d, expected %d", c.flag, c.severity, weight, c.weight)
+		}
+	}
+}
+
+// responses makes a result set with one response per flag, all from tests of
+// the given severity
+func responses(severity pb.Severity, flags ...pb.Flag) []*pb.ValidateResponse {
+	resps := make([]*pb.ValidateResponse, len(flags))
+	for i, f := range flags {
+		resps[i] = &pb.ValidateResponse{Flag: f, Severity: severity}
+	}
+	return resps
+}
+
+func TestWorstOfVerdict(t *testing.T) {
+	cases := []struct {
+		name    string
+		flags   []*pb.ValidateResponse
+		verdict pb.Flag
+	}{
+		{"no results", nil, pb.Flag_OK},
+		{"all ok", responses(pb.Severity_LOW, pb.Flag_OK, pb.Flag_OK), pb.Flag_OK},
+		{"one warning", responses(pb.Severity_LOW, pb.Flag_OK, pb.Flag_WARN, pb.Flag_OK), pb.Flag_WARN},
+		{"missing beats warning", responses(pb.Severity_LOW, pb.Flag_WARN, pb.Flag_MISSING), pb.Flag_MISSING},
+		{"error beats failure", responses(pb.Severity_LOW, pb.Flag_ERROR, pb.Flag_FAIL), pb.Flag_ERROR},
+		// a skipped test ranks with OK, so it never makes the verdict worse
+		{"skipped", responses(pb.Severity_LOW, pb.Flag_OK, pb.Flag_SKIPPED), pb.Flag_OK},
+		{"only skipped", responses(pb.Severity_LOW, pb.Flag_SKIPPED, pb.Flag_SKIPPED), pb.Flag_OK},
+		{"skipped and warning", responses(pb.Severity_LOW, pb.Flag_SKIPPED, pb.Flag_WARN), pb.Flag_WARN},
+		{"tied failures", responses(pb.Severity_LOW, pb.Flag_FAIL, pb.Flag_OK, pb.Flag_FAIL), pb.Flag_FAIL},
+		// severity doesn't matter to worst-of
+		{"low severity failure", responses(pb.Severity_LOW, pb.Flag_FAIL), pb.Flag_FAIL},
+	}
+
+	for _, c := range cases {
+		if verdict := worstOfVerdict(c.flags); verdict != c.verdict {
+			t.Errorf("%s: verdict is %s, expected %s", c.name, verdict, c.verdict)
+		}
+	}
+}
+
+func TestAnyFailVerdict(t *testing.T) {
+	cases := []struct {
+		name    string
+		flags   []*pb.ValidateResponse
+		verdict pb.Flag
+	}{
+		{"no results", nil, pb.Flag_OK},
+		{"all ok", responses(pb.Severity_HIGH, pb.Flag_OK, pb.Flag_OK), pb.Flag_OK},
+		// only failures count, however many warnings there are
+		{"only warnings", responses(pb.Severity_HIGH, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_MISSING), pb.Flag_OK},
+		{"one failure among passes", responses(pb.Severity_LOW, pb.Flag_OK, pb.Flag_OK, pb.Flag_FAIL), pb.Flag_FAIL},
+		{"error", responses(pb.Severity_LOW, pb.Flag_OK, pb.Flag_ERROR), pb.Flag_FAIL},
+	}
+
+	for _, c := range cases {
+		if verdict := anyFailVerdict(c.flags); verdict != c.verdict {
+			t.Errorf("%s: verdict is %s, expected %s", c.name, verdict, c.verdict)
+		}
+	}
+}
+
+func TestNewVerdictPolicy(t *testing.T) {
+	for _, name := range []string{"worst-of", "any-fail", "weighted"} {
+		if _, err := newVerdictPolicy(name, 8); err != nil {
+			t.Errorf("policy %s: %v", name, err)
+		}
+	}
+	if _, err := newVerdictPolicy("best-of", 8); err == nil {
+		t.Errorf("got an unknown policy, expected an error")
+	}
+	if _, err := newVerdictPolicy("weighted", 0); err == nil {
+		t.Errorf("got a weighted policy with a fail weight of 0, expected an error")
+	}
+}
+
+func TestWeightedVerdict(t *testing.T) {
+	mixed := append(responses(pb.Severity_HIGH, pb.Flag_FAIL), responses(pb.Severity_LOW, pb.Flag_OK, pb.Flag_OK, pb.Flag_OK)...)
+	many_warnings := append(responses(pb.Severity_LOW, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_WARN), responses(pb.Severity_MEDIUM, pb.Flag_WARN, pb.Flag_WARN)...)
+
+	cases := []struct {
+		name    string
+		flags   []*pb.ValidateResponse
+		verdict pb.Flag
+	}{
+		{"no results", nil, pb.Flag_OK},
+		{"all ok", responses(pb.Severity_HIGH, pb.Flag_OK, pb.Flag_OK), pb.Flag_OK},
+		// one HIGH failure is enough on its own
+		{"one high failure among passes", mixed, pb.Flag_FAIL},
+		{"one high error", responses(pb.Severity_HIGH, pb.Flag_ERROR), pb.Flag_FAIL},
+		{"one medium failure", responses(pb.Severity_MEDIUM, pb.Flag_FAIL), pb.Flag_WARN},
+		// exactly the fail weight is a failure
+		{"two medium failures", responses(pb.Severity_MEDIUM, pb.Flag_FAIL, pb.Flag_FAIL), pb.Flag_FAIL},
+		{"one high warning", responses(pb.Severity_HIGH, pb.Flag_WARN), pb.Flag_WARN},
+		// 3*1 + 2*2 falls just short of 8
+		{"low and medium warnings", many_warnings, pb.Flag_WARN},
+		{"low warnings add up", responses(pb.Severity_LOW, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_WARN, pb.Flag_WARN), pb.Flag_FAIL},
+		// missing and skipped results carry no weight
+		{"missing and skipped", responses(pb.Severity_HIGH, pb.Flag_MISSING, pb.Flag_SKIPPED), pb.Flag_OK},
+	}
+
+	policy := newWeightedVerdict(8)
+	for _, c := range cases {
+		if verdict := policy(c.flags); verdict != c.verdict {
+			t.Errorf("%s: verdict is %s, expected %s", c.name, verdict, c.verdict)
+		}
+	}
+
+	// a lower threshold fails on less
+	if verdict := newWeightedVerdict(4)(responses(pb.Severity_MEDIUM, pb.Flag_FAIL)); verdict != pb.Flag_FAIL {
+		t.Errorf("verdict of a medium failure with a fail weight of 4 is %s, expected FAIL", verdict)
+	}
+}
@@ -2,15 +2,23 @@ module github.com/metno/rove
 
 go 1.17
 
+require (
+	github.com/lib/pq v1.10.6
+	github.com/segmentio/kafka-go v0.4.47
+	golang.org/x/time v0.0.0-20220722155302-e5dcc9cfc0b9
+	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013
+	google.golang.org/grpc v1.48.0
+	google.golang.org/protobuf v1.27.1
+)
+
 require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/intarga/dagrid v0.0.0-20220711171430-7e41b684f657 // indirect
-	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
-	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4 // indirect
-	golang.org/x/text v0.3.3 // indirect
-	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
-	google.golang.org/grpc v1.48.0 // indirect
-	google.golang.org/protobuf v1.27.1 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
 
 replace github.com/intarga/dagrid => ../dagrid
@@ -0,0 +1,57 @@
+// Package rovecore holds what the coordinator and its clients have to agree
+// on, so neither has to import the other for it.
+package rovecore
+
+import (
+	"fmt"
+	pb "github.com/metno/rove/proto"
+	"strings"
+)
+
+const (
+	// ErrorDomain is the domain of the ErrorInfo details the coordinator
+	// attaches to the errors it returns
+	ErrorDomain = "rove.met.no"
+	// ReasonUnknownTests is the ErrorInfo reason for a request naming tests
+	// that aren't in the dag. The tests are listed, comma separated, under
+	// the "tests" metadata key
+	ReasonUnknownTests = "UNKNOWN_TESTS"
+)
+
+// FlagRank orders flags from best to worst, the order the coordinator's
+// worst-of verdict policy uses. A skipped test ranks with OK, since nothing
+// is known to be wrong with the data. Flags that aren't test results, like
+// UNSPECIFIED, rank below all of them.
+func FlagRank(flag pb.Flag) int {
+	switch flag {
+	case pb.Flag_OK, pb.Flag_SKIPPED:
+		return 1
+	case pb.Flag_WARN:
+		return 2
+	case pb.Flag_MISSING:
+		return 3
+	case pb.Flag_FAIL:
+		return 4
+	case pb.Flag_ERROR:
+		return 5
+	default:
+		return 0
+	}
+}
+
+// Dot formats a dag as a Graphviz DOT graph, with an edge from each test to
+// each test it depends on. edges are [parent, child] pairs, where the parent
+// depends on the child. Tests and edges are written in the order given.
+func Dot(tests []string, edges [][2]string) string {
+	var b strings.Builder
+	b.WriteString("digraph pipeline {\n")
+	for _, test := range tests {
+		fmt.Fprintf(&b, "\t%q;\n", test)
+	}
+	for _, edge := range edges {
+		fmt.Fprintf(&b, "\t%q -> %q;\n", edge[0], edge[1])
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
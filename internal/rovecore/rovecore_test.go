@@ -0,0 +1,39 @@
+package rovecore
+
+import (
+	pb "github.com/metno/rove/proto"
+	"testing"
+)
+
+func TestFlagRankOrder(t *testing.T) {
+	// best to worst, with flags on the same line ranking equal
+	order := [][]pb.Flag{
+		{pb.Flag_OK, pb.Flag_SKIPPED},
+		{pb.Flag_WARN},
+		{pb.Flag_MISSING},
+		{pb.Flag_FAIL},
+		{pb.Flag_ERROR},
+	}
+
+	for i, flags := range order {
+		for _, f := range flags {
+			if FlagRank(f) != FlagRank(flags[0]) {
+				t.Errorf("%s ranks %d, expected the same as %s", f, FlagRank(f), flags[0])
+			}
+			if i > 0 && FlagRank(f) <= FlagRank(order[i-1][0]) {
+				t.Errorf("%s ranks %d, expected worse than %s", f, FlagRank(f), order[i-1][0])
+			}
+		}
+	}
+}
+
+func TestDot(t *testing.T) {
+	expected := "digraph pipeline {\n" +
+		"\t\"test1\";\n" +
+		"\t\"test2\";\n" +
+		"\t\"test1\" -> \"test2\";\n" +
+		"}\n"
+	if dot := Dot([]string{"test1", "test2"}, [][2]string{{"test1", "test2"}}); dot != expected {
+		t.Errorf("dot is\n%s\nexpected\n%s", dot, expected)
+	}
+}
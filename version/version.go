@@ -0,0 +1,20 @@
+// Package version holds build information for the rove binaries. It is filled
+// in at build time with
+//
+//	go build -ldflags "-X github.com/metno/rove/version.Version=v1.2.3 \
+//		-X github.com/metno/rove/version.Commit=$(git rev-parse HEAD) \
+//		-X github.com/metno/rove/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import "fmt"
+
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// String describes the build, for --version output and logs
+func String() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", Version, Commit, BuildTime)
+}